@@ -2,8 +2,10 @@ package config
 
 import (
 	"io/ioutil"
+	"sort"
 
 	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
 )
 
 func ReadConfig(filename string) (ServerConfig, error) {
@@ -12,12 +14,14 @@ func ReadConfig(filename string) (ServerConfig, error) {
 }
 
 type ServerConfig struct {
-	Bind []string                `hcl:"bind,omitempty" json:"bind,omitempty"`
-	Cert []string                `hcl:"cert,omitempty" json:"cert,omitempty"`
-	CA   []string                `hcl:"ca" json:"ca"`
-	GRPC bool                    `hcl:"grpc,omitempty" json:"grpc,omitempty"`
-	AppM []map[string]*AppConfig `hcl:"app,omitempty" json:"app,omitempty"`
-	App  []*AppConfig            `hcl:"-" json:"-"`
+	Bind  []string                `hcl:"bind,omitempty" json:"bind,omitempty"`
+	Cert  []string                `hcl:"cert,omitempty" json:"cert,omitempty"`
+	CA    []string                `hcl:"ca" json:"ca"`
+	GRPC  bool                    `hcl:"grpc,omitempty" json:"grpc,omitempty"`
+	Admin string                  `hcl:"admin,omitempty" json:"admin,omitempty"`
+	XDS   *XDSConfig              `hcl:"xds,omitempty" json:"xds,omitempty"`
+	AppM  []map[string]*AppConfig `hcl:"app,omitempty" json:"app,omitempty"`
+	App   []*AppConfig            `hcl:"-" json:"-"`
 }
 
 func (this *ServerConfig) Read(filename string) error {
@@ -37,7 +41,8 @@ func (this *ServerConfig) Read(filename string) error {
 
 func (this *ServerConfig) Init() {
 	for _, m := range this.AppM {
-		for name, app := range m {
+		for _, name := range names(m) {
+			app := m[name]
 			app.link()
 			app.server = this
 			app.Name = name
@@ -53,12 +58,13 @@ func (this *ServerConfig) Init() {
 type AppConfig struct {
 	server *ServerConfig
 
-	Name   string                    `hcl:"-" json:"-"`
-	Host   string                    `hcl:"host,omitempty" json:"host,omitempty"`
-	GRPC   *bool                     `hcl:"grpc,omitempty" json:"grpc,omitempty"`
-	CA     []string                  `hcl:"ca" json:"ca"`
-	ProxyM []map[string]*ProxyConfig `hcl:"proxy,omitempty" json:"proxy,omitempty"`
-	Proxy  []*ProxyConfig            `hcl:"-" json:"-"`
+	Name     string                    `hcl:"-" json:"-"`
+	Host     string                    `hcl:"host,omitempty" json:"host,omitempty"`
+	GRPC     *bool                     `hcl:"grpc,omitempty" json:"grpc,omitempty"`
+	Priority int                       `hcl:"priority,omitempty" json:"priority,omitempty"`
+	CA       []string                  `hcl:"ca" json:"ca"`
+	ProxyM   []map[string]*ProxyConfig `hcl:"proxy,omitempty" json:"proxy,omitempty"`
+	Proxy    []*ProxyConfig            `hcl:"-" json:"-"`
 }
 
 func (this *AppConfig) GetGRPC() bool {
@@ -79,7 +85,8 @@ func (this *AppConfig) GetCA() []string {
 
 func (this *AppConfig) link() {
 	for _, m := range this.ProxyM {
-		for name, proxy := range m {
+		for _, name := range names(m) {
+			proxy := m[name]
 			proxy.link()
 			proxy.app = this
 			proxy.Name = name
@@ -97,13 +104,46 @@ type ProxyConfig struct {
 
 	Name               string   `hcl:"-" json:"-"`
 	URI                string   `hcl:"uri,omitempty" json:"uri,omitempty"`
+	ExactURI           bool     `hcl:"exact_uri,omitempty" json:"exact_uri,omitempty"` // uri patterns match whole, not as prefixes
 	Host               string   `hcl:"host,omitempty" json:"host,omitempty"`
 	GRPC               *bool    `hcl:"grpc,omitempty" json:"grpc,omitempty"`
 	Backend            string   `hcl:"backend,omitempty" json:"backend,omitempty"`
+	Priority           int      `hcl:"priority,omitempty" json:"priority,omitempty"`
 	Policy             string   `hcl:"policy,omitempty" json:"policy,omitempty"`
+	Overprovisioning   int      `hcl:"overprovisioning,omitempty" json:"overprovisioning,omitempty"`
+	SplitKey           string   `hcl:"split_key,omitempty" json:"split_key,omitempty"`
 	CA                 []string `hcl:"ca" json:"ca"`
 	TLS                bool     `hcl:"tls,omitempty" json:"tls,omitempty"`
 	InsecureSkipVerify bool     `hcl:"insecure_skip_verify,omitempty" json:"insecure_skip_verify,omitempty"`
+	DefaultTimeout     string   `hcl:"default_timeout,omitempty" json:"default_timeout,omitempty"`
+	MaxTimeout         string   `hcl:"max_timeout,omitempty" json:"max_timeout,omitempty"`
+
+	HealthCheck      *HealthCheckConfig      `hcl:"health_check,omitempty" json:"health_check,omitempty"`
+	OutlierDetection *OutlierDetectionConfig `hcl:"outlier_detection,omitempty" json:"outlier_detection,omitempty"`
+	CircuitBreaker   *CircuitBreakerConfig   `hcl:"circuit_breaker,omitempty" json:"circuit_breaker,omitempty"`
+	SlowStart        *SlowStartConfig        `hcl:"slow_start,omitempty" json:"slow_start,omitempty"`
+	Retry            *RetryConfig            `hcl:"retry,omitempty" json:"retry,omitempty"`
+	Hedge            *HedgeConfig            `hcl:"hedge,omitempty" json:"hedge,omitempty"`
+
+	Sticky *StickyConfig `hcl:"sticky,omitempty" json:"sticky,omitempty"`
+	Mirror *MirrorConfig `hcl:"mirror,omitempty" json:"mirror,omitempty"`
+	Fault  *FaultConfig  `hcl:"fault,omitempty" json:"fault,omitempty"`
+
+	MatchM []map[string]*HeaderMatchConfig `hcl:"match,omitempty" json:"match,omitempty"`
+	Match  []*HeaderMatchConfig            `hcl:"-" json:"-"`
+
+	FailoverM []map[string]*FailoverConfig `hcl:"failover,omitempty" json:"failover,omitempty"`
+	Failover  []*FailoverConfig            `hcl:"-" json:"-"`
+
+	ClusterM []map[string]*ClusterConfig `hcl:"cluster,omitempty" json:"cluster,omitempty"`
+	Cluster  []*ClusterConfig            `hcl:"-" json:"-"`
+
+	DiscoveryM []map[string]*DiscoveryConfig `hcl:"discovery,omitempty" json:"discovery,omitempty"`
+	Discovery  []*DiscoveryConfig            `hcl:"-" json:"-"`
+
+	// Balancer holds the options block of the policy, decoded by
+	// DecodeBalancer once the policy is known.
+	Balancer ast.Node `hcl:"balancer,omitempty" json:"-"`
 }
 
 func (this *ProxyConfig) GetGRPC() bool {
@@ -122,6 +162,192 @@ func (this *ProxyConfig) GetCA() []string {
 	return this.CA
 }
 
+// DecodeBalancer decodes the balancer options block into out. It leaves
+// out untouched if the block is absent.
+func (this *ProxyConfig) DecodeBalancer(out interface{}) error {
+	if this.Balancer == nil || out == nil {
+		return nil
+	}
+
+	return hcl.DecodeObject(out, this.Balancer)
+}
+
 func (this *ProxyConfig) link() {
+	for _, m := range this.DiscoveryM {
+		for _, name := range names(m) {
+			discovery := m[name]
+			discovery.Provider = name
+			this.Discovery = append(this.Discovery, discovery)
+		}
+	}
+
+	for _, m := range this.ClusterM {
+		for _, name := range names(m) {
+			cluster := m[name]
+			cluster.Name = name
+			this.Cluster = append(this.Cluster, cluster)
+		}
+	}
+
+	for _, m := range this.MatchM {
+		for _, name := range names(m) {
+			match := m[name]
+			match.Name = name
+			this.Match = append(this.Match, match)
+		}
+	}
+
+	for _, m := range this.FailoverM {
+		for _, name := range names(m) {
+			failover := m[name]
+			failover.Name = name
+			this.Failover = append(this.Failover, failover)
+		}
+	}
+}
+
+// FailoverConfig declares a lower priority tier of backends. Tiers are
+// tried in the order they are declared, after the proxy's own backends,
+// and receive traffic once the tiers above them are short of available
+// backends, as scaled by the proxy's overprovisioning percentage.
+//
+//	overprovisioning = 140
+//
+//	failover "dc2" {
+//	    backend = "https://dc2.example.com:8000"
+//	}
+type FailoverConfig struct {
+	Name    string `hcl:"-" json:"-"`
+	Backend string `hcl:"backend,omitempty" json:"backend,omitempty"`
+}
+
+// ClusterConfig is a named set of backends taking weight parts of the
+// traffic of a proxy, in place of the proxy's own backend list. With
+// split_key set on the proxy, requests are split by the hash of that key
+// (in the format of the hash_key balancer option) instead of at random,
+// so a user keeps landing in the same cluster; declare the canary cluster
+// last so that ramping it up doesn't move its users back.
+//
+//	split_key = "header:x-user-id"
+//
+//	cluster "stable" {
+//	    backend = "http://127.0.0.1:51001"
+//	    weight = 95
+//	}
+//
+//	cluster "canary" {
+//	    backend = "http://127.0.0.1:51002"
+//	    weight = 5
+//	}
+type ClusterConfig struct {
+	Name    string `hcl:"-" json:"-"`
+	Backend string `hcl:"backend,omitempty" json:"backend,omitempty"`
+	Weight  int    `hcl:"weight,omitempty" json:"weight,omitempty"`
+}
+
+// MirrorConfig copies a share of a proxy's requests to a shadow cluster,
+// tagged with the header header. Shadow responses are discarded, and
+// requests whose body exceeds max_buffer_size are not copied.
+//
+//	mirror {
+//	    backend = "http://127.0.0.1:51002"
+//	    percent = 10
+//	    header = "x-grpcproxy-shadow"
+//	    max_buffer_size = 65536
+//	    timeout = "5s"
+//	    max_in_flight = 256
+//	}
+type MirrorConfig struct {
+	Backend       string  `hcl:"backend,omitempty" json:"backend,omitempty"`
+	Percent       float64 `hcl:"percent,omitempty" json:"percent,omitempty"`
+	Header        string  `hcl:"header,omitempty" json:"header,omitempty"`
+	MaxBufferSize int     `hcl:"max_buffer_size,omitempty" json:"max_buffer_size,omitempty"`
+	Timeout       string  `hcl:"timeout,omitempty" json:"timeout,omitempty"`
+	MaxInFlight   int     `hcl:"max_in_flight,omitempty" json:"max_in_flight,omitempty"`
+}
+
+// FaultConfig delays or aborts a share of a proxy's requests, optionally
+// only those carrying the header header, to test clients against a slow
+// or failing service. abort_http_status answers non grpc requests.
+//
+//	fault {
+//	    delay = "200ms"
+//	    delay_percent = 50
+//	    abort_code = "unavailable"
+//	    abort_message = "injected by grpcproxy"
+//	    abort_http_status = 503
+//	    abort_percent = 10
+//	    header = "x-chaos"
+//	}
+type FaultConfig struct {
+	Delay           string  `hcl:"delay,omitempty" json:"delay,omitempty"`
+	DelayPercent    float64 `hcl:"delay_percent,omitempty" json:"delay_percent,omitempty"`
+	AbortCode       string  `hcl:"abort_code,omitempty" json:"abort_code,omitempty"`
+	AbortMessage    string  `hcl:"abort_message,omitempty" json:"abort_message,omitempty"`
+	AbortHTTPStatus int     `hcl:"abort_http_status,omitempty" json:"abort_http_status,omitempty"`
+	AbortPercent    float64 `hcl:"abort_percent,omitempty" json:"abort_percent,omitempty"`
+	Header          string  `hcl:"header,omitempty" json:"header,omitempty"`
+}
+
+// StickyConfig pins sessions to backends. With key set, the session is read
+// from that metadata key; otherwise the proxy issues an affinity token in
+// the header response header for grpc clients to send back, and in the
+// cookie cookie for plain http clients.
+//
+//	sticky {
+//	    key = "x-session-id"
+//	    ttl = "30m"
+//	    max_sessions = 65536
+//	}
+//
+//	sticky {
+//	    header = "x-grpcproxy-affinity"
+//	    cookie = "grpcproxy-affinity"
+//	}
+type StickyConfig struct {
+	Key         string `hcl:"key,omitempty" json:"key,omitempty"`
+	Header      string `hcl:"header,omitempty" json:"header,omitempty"`
+	Cookie      string `hcl:"cookie,omitempty" json:"cookie,omitempty"`
+	TTL         string `hcl:"ttl,omitempty" json:"ttl,omitempty"`
+	MaxSessions int    `hcl:"max_sessions,omitempty" json:"max_sessions,omitempty"`
+}
+
+// HeaderMatchConfig restricts a proxy to requests whose header, or grpc
+// metadata, named by the block label matches. Every match block of a proxy
+// must match, and each sets exactly one of exact, prefix, regex, present
+// and absent. Proxies are tried by priority, then the more specific host,
+// the longer uri, the more match blocks and finally declaration order, so
+// a proxy with match blocks goes before the catch-all proxy of the same
+// priority, host and uri.
+//
+//	match "x-tenant" {
+//	    exact = "acme"
+//	}
+//
+//	match "x-env" {
+//	    regex = "canary|staging"
+//	}
+//
+//	match "x-debug" {
+//	    absent = true
+//	}
+type HeaderMatchConfig struct {
+	Name    string `hcl:"-" json:"-"`
+	Exact   string `hcl:"exact,omitempty" json:"exact,omitempty"`
+	Prefix  string `hcl:"prefix,omitempty" json:"prefix,omitempty"`
+	Regex   string `hcl:"regex,omitempty" json:"regex,omitempty"`
+	Present bool   `hcl:"present,omitempty" json:"present,omitempty"`
+	Absent  bool   `hcl:"absent,omitempty" json:"absent,omitempty"`
+}
+
+// names returns the keys of m sorted, so that blocks decoded into the same
+// map are linked in a deterministic order.
+func names[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
 
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,121 @@
+package config
+
+// DiscoveryConfig sources the backends of a proxy from the provider named
+// by the block label, in place of backend. Every provider keeps the
+// backends it found last when a lookup fails or finds none, and drains
+// those it reports unhealthy.
+//
+// A proxy with a discovery block can't have backend, failover, cluster or
+// sticky blocks too: sticky sessions need a fixed set of backends to issue
+// affinity tokens for.
+//
+//	discovery "dns" {
+//	    name = "foo.service.local"
+//	    port = 8000
+//	    interval = "30s"
+//	}
+//
+//	discovery "dns" {
+//	    name = "_grpc._tcp.foo.service.local"
+//	    type = "srv"
+//	    server = "127.0.0.1:5353"
+//	}
+//
+//	discovery "file" {
+//	    path = "/etc/grpcproxy/foo.json"
+//	}
+//
+//	discovery "consul" {
+//	    address = "http://127.0.0.1:8500"
+//	    service = "foo"
+//	    tag = "v2"
+//	    datacenter = "dc1"
+//	    wait = "5m"
+//	}
+//
+//	discovery "xds" {
+//	    cluster = "foo"
+//	}
+//
+//	discovery "kubernetes" {
+//	    namespace = "prod"
+//	    service = "foo"
+//	    port_name = "grpc"
+//	}
+//
+// A discovery file lists one entry per backend:
+//
+//	[
+//	    {"address": "10.0.0.1:8000", "weight": 10, "zone": "a", "metadata": {"version": "v2"}},
+//	    {"address": "10.0.0.2:8000", "priority": 1}
+//	]
+type DiscoveryConfig struct {
+	Provider string `hcl:"-" json:"-"`
+
+	// dns: name is resolved every interval, within timeout, through server
+	// or the system resolver if empty. Type "a" joins the A / AAAA records
+	// with port, type "srv" resolves the targets of the records the same way
+	// and gives their addresses the port, priority and weight of the record.
+	Name     string `hcl:"name,omitempty" json:"name,omitempty"`
+	Port     int    `hcl:"port,omitempty" json:"port,omitempty"`
+	Type     string `hcl:"type,omitempty" json:"type,omitempty"`
+	Interval string `hcl:"interval,omitempty" json:"interval,omitempty"`
+	Timeout  string `hcl:"timeout,omitempty" json:"timeout,omitempty"`
+	Server   string `hcl:"server,omitempty" json:"server,omitempty"`
+
+	// file: path is read again whenever it changes, regardless of config
+	// reloads, as json or yaml as format, or else its extension, tells.
+	Path   string `hcl:"path,omitempty" json:"path,omitempty"`
+	Format string `hcl:"format,omitempty" json:"format,omitempty"`
+
+	// consul: the instances of service having tag, in datacenter, are
+	// watched through the health api of the agent at address, with
+	// blocking queries held for up to wait. Instances with critical checks
+	// are unhealthy.
+	Address    string `hcl:"address,omitempty" json:"address,omitempty"`
+	Service    string `hcl:"service,omitempty" json:"service,omitempty"`
+	Tag        string `hcl:"tag,omitempty" json:"tag,omitempty"`
+	Datacenter string `hcl:"datacenter,omitempty" json:"datacenter,omitempty"`
+	Token      string `hcl:"token,omitempty" json:"token,omitempty"`
+	Wait       string `hcl:"wait,omitempty" json:"wait,omitempty"`
+
+	// xds: the endpoints of cluster come from the control plane of the
+	// server's xds block.
+	Cluster string `hcl:"cluster,omitempty" json:"cluster,omitempty"`
+
+	// kubernetes: the endpoint slices of service in namespace are watched
+	// through the api server of kubeconfig, or of the cluster the proxy
+	// runs in if empty, waiting up to timeout for the first listing and
+	// listing them again every interval if set. port_name, or port, picks
+	// the port of services with several; port is the port of the service,
+	// not the target port of its pods, and takes the right to get the
+	// service. Endpoints which aren't ready, or are terminating, are
+	// unhealthy.
+	Namespace  string `hcl:"namespace,omitempty" json:"namespace,omitempty"`
+	PortName   string `hcl:"port_name,omitempty" json:"port_name,omitempty"`
+	Kubeconfig string `hcl:"kubeconfig,omitempty" json:"kubeconfig,omitempty"`
+}
+
+// XDSConfig connects the server to an envoy style control plane over the
+// aggregated discovery service, as node node_id of node_cluster. Proxies
+// with an xds discovery take the endpoints of a cds cluster, waiting up to
+// timeout for them when built. The virtual hosts of the route_config
+// route configurations are served as apps too, one proxy per route. They
+// rank below the apps of this file without a priority, the more specific
+// their domains the higher, and their routes are tried in order.
+//
+//	xds {
+//	    address = "127.0.0.1:18000"
+//	    node_id = "grpcproxy-1"
+//	    node_cluster = "edge"
+//	    route_config = ["local_route"]
+//	    timeout = "5s"
+//	}
+type XDSConfig struct {
+	Address     string   `hcl:"address,omitempty" json:"address,omitempty"`
+	TLS         bool     `hcl:"tls,omitempty" json:"tls,omitempty"`
+	NodeID      string   `hcl:"node_id,omitempty" json:"node_id,omitempty"`
+	NodeCluster string   `hcl:"node_cluster,omitempty" json:"node_cluster,omitempty"`
+	RouteConfig []string `hcl:"route_config,omitempty" json:"route_config,omitempty"`
+	Timeout     string   `hcl:"timeout,omitempty" json:"timeout,omitempty"`
+}
@@ -0,0 +1,112 @@
+package config
+
+// HealthCheckConfig describes an active grpc.health.v1 check against every
+// backend of a proxy.
+//
+//	health_check {
+//	    interval = "5s"
+//	    timeout = "1s"
+//	    unhealthy_threshold = 3
+//	    healthy_threshold = 2
+//	    service = "rpc.Foo"
+//	}
+type HealthCheckConfig struct {
+	Interval           string `hcl:"interval,omitempty" json:"interval,omitempty"`
+	Timeout            string `hcl:"timeout,omitempty" json:"timeout,omitempty"`
+	UnhealthyThreshold int    `hcl:"unhealthy_threshold,omitempty" json:"unhealthy_threshold,omitempty"`
+	HealthyThreshold   int    `hcl:"healthy_threshold,omitempty" json:"healthy_threshold,omitempty"`
+	Service            string `hcl:"service,omitempty" json:"service,omitempty"`
+}
+
+// OutlierDetectionConfig ejects backends based on the responses that pass
+// through the proxy.
+//
+//	outlier_detection {
+//	    interval = "10s"
+//	    consecutive_failures = 5
+//	    failure_percent = 50
+//	    request_volume = 20
+//	    base_ejection_time = "30s"
+//	    max_ejection_time = "300s"
+//	    max_ejection_percent = 10
+//	}
+type OutlierDetectionConfig struct {
+	Interval            string `hcl:"interval,omitempty" json:"interval,omitempty"`
+	ConsecutiveFailures int    `hcl:"consecutive_failures,omitempty" json:"consecutive_failures,omitempty"`
+	FailurePercent      int    `hcl:"failure_percent,omitempty" json:"failure_percent,omitempty"`
+	RequestVolume       int    `hcl:"request_volume,omitempty" json:"request_volume,omitempty"`
+	BaseEjectionTime    string `hcl:"base_ejection_time,omitempty" json:"base_ejection_time,omitempty"`
+	MaxEjectionTime     string `hcl:"max_ejection_time,omitempty" json:"max_ejection_time,omitempty"`
+	MaxEjectionPercent  int    `hcl:"max_ejection_percent,omitempty" json:"max_ejection_percent,omitempty"`
+}
+
+// CircuitBreakerConfig guards every backend of a proxy with its own breaker.
+//
+//	circuit_breaker {
+//	    window = "10s"
+//	    error_percent = 50
+//	    request_volume = 20
+//	    max_requests = 1000
+//	    open_timeout = "30s"
+//	    half_open_requests = 3
+//	}
+type CircuitBreakerConfig struct {
+	Window           string `hcl:"window,omitempty" json:"window,omitempty"`
+	ErrorPercent     int    `hcl:"error_percent,omitempty" json:"error_percent,omitempty"`
+	RequestVolume    int    `hcl:"request_volume,omitempty" json:"request_volume,omitempty"`
+	MaxRequests      int    `hcl:"max_requests,omitempty" json:"max_requests,omitempty"`
+	OpenTimeout      string `hcl:"open_timeout,omitempty" json:"open_timeout,omitempty"`
+	HalfOpenRequests int    `hcl:"half_open_requests,omitempty" json:"half_open_requests,omitempty"`
+}
+
+// SlowStartConfig ramps up the weight of backends which were just added or
+// returned to service, from min_weight_percent to their full weight.
+//
+//	slow_start {
+//	    window = "60s"
+//	    aggression = 1.0
+//	    min_weight_percent = 10
+//	}
+type SlowStartConfig struct {
+	Window           string  `hcl:"window,omitempty" json:"window,omitempty"`
+	Aggression       float64 `hcl:"aggression,omitempty" json:"aggression,omitempty"`
+	MinWeightPercent int     `hcl:"min_weight_percent,omitempty" json:"min_weight_percent,omitempty"`
+}
+
+// RetryConfig retries failed requests on other backends as long as no
+// response header has been sent to the client.
+//
+//	retry {
+//	    max_attempts = 3
+//	    retry_on = ["unavailable", "resource_exhausted"]
+//	    backoff_base = "25ms"
+//	    backoff_max = "250ms"
+//	    per_try_timeout = "1s"
+//	    max_buffer_size = 65536
+//	}
+type RetryConfig struct {
+	MaxAttempts   int      `hcl:"max_attempts,omitempty" json:"max_attempts,omitempty"`
+	RetryOn       []string `hcl:"retry_on,omitempty" json:"retry_on,omitempty"`
+	BackoffBase   string   `hcl:"backoff_base,omitempty" json:"backoff_base,omitempty"`
+	BackoffMax    string   `hcl:"backoff_max,omitempty" json:"backoff_max,omitempty"`
+	PerTryTimeout string   `hcl:"per_try_timeout,omitempty" json:"per_try_timeout,omitempty"`
+	MaxBufferSize int      `hcl:"max_buffer_size,omitempty" json:"max_buffer_size,omitempty"`
+}
+
+// HedgeConfig sends additional copies of requests for the listed
+// idempotent methods when the first backend is slow to answer.
+//
+//	hedge {
+//	    methods = ["/rpc.Foo/Chat"]
+//	    delay = "50ms"
+//	    max_attempts = 2
+//	    non_fatal = ["unavailable"]
+//	    max_buffer_size = 65536
+//	}
+type HedgeConfig struct {
+	Methods       []string `hcl:"methods,omitempty" json:"methods,omitempty"`
+	Delay         string   `hcl:"delay,omitempty" json:"delay,omitempty"`
+	MaxAttempts   int      `hcl:"max_attempts,omitempty" json:"max_attempts,omitempty"`
+	NonFatal      []string `hcl:"non_fatal,omitempty" json:"non_fatal,omitempty"`
+	MaxBufferSize int      `hcl:"max_buffer_size,omitempty" json:"max_buffer_size,omitempty"`
+}
@@ -8,6 +8,8 @@ import (
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"github.com/dtynn/grpcproxy/example/rpc"
 )
@@ -39,6 +41,7 @@ func (this *Service) Run() error {
 
 	server := grpc.NewServer()
 	rpc.RegisterBarServer(server, this)
+	healthpb.RegisterHealthServer(server, health.NewServer())
 
 	log.Printf("listen on %s", addr)
 
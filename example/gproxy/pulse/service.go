@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"github.com/dtynn/grpcproxy/example/rpc"
 )
@@ -57,6 +59,7 @@ func (this *Service) Run() error {
 
 	server := grpc.NewServer()
 	rpc.RegisterPulseServer(server, this)
+	healthpb.RegisterHealthServer(server, health.NewServer())
 
 	log.Printf("listen on %s", addr)
 
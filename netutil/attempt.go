@@ -0,0 +1,114 @@
+package netutil
+
+import (
+	"net/http"
+	"sync"
+)
+
+var (
+	_ http.ResponseWriter = &attemptWriter{}
+	_ http.Flusher        = &attemptWriter{}
+)
+
+// attemptWriter holds back the response of one attempt until its headers
+// arrive. A response that discard accepts is swallowed so that the request
+// can be attempted again; any other response is committed to rw.
+type attemptWriter struct {
+	rw      http.ResponseWriter
+	header  http.Header
+	discard func(status int, header http.Header) bool
+
+	mu        sync.Mutex
+	committed bool
+	discarded bool
+}
+
+func newAttemptWriter(rw http.ResponseWriter, discard func(int, http.Header) bool) *attemptWriter {
+	return &attemptWriter{
+		rw:      rw,
+		header:  make(http.Header),
+		discard: discard,
+	}
+}
+
+func (this *attemptWriter) Header() http.Header {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.committed {
+		return this.rw.Header()
+	}
+
+	return this.header
+}
+
+func (this *attemptWriter) WriteHeader(code int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.writeHeader(code)
+}
+
+func (this *attemptWriter) writeHeader(code int) {
+	if this.committed || this.discarded {
+		return
+	}
+
+	if this.discard != nil && this.discard(code, this.header) {
+		this.discarded = true
+		return
+	}
+
+	h := this.rw.Header()
+	for k, vv := range this.header {
+		h[k] = vv
+	}
+
+	this.committed = true
+	this.rw.WriteHeader(code)
+}
+
+func (this *attemptWriter) Write(b []byte) (int, error) {
+	this.mu.Lock()
+	this.writeHeader(http.StatusOK)
+	discarded := this.discarded
+	this.mu.Unlock()
+
+	if discarded {
+		return len(b), nil
+	}
+
+	return this.rw.Write(b)
+}
+
+func (this *attemptWriter) Flush() {
+	this.mu.Lock()
+	committed := this.committed
+	this.mu.Unlock()
+
+	if !committed {
+		return
+	}
+
+	if f, ok := this.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Discarded reports whether the response of the attempt was thrown away.
+func (this *attemptWriter) Discarded() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.discarded
+}
+
+// cancelUncommitted runs cancel unless the attempt already committed its response.
+func (this *attemptWriter) cancelUncommitted(cancel func()) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if !this.committed {
+		cancel()
+	}
+}
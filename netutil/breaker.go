@@ -0,0 +1,220 @@
+package netutil
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (this BreakerState) String() string {
+	switch this {
+	case BreakerClosed:
+		return "closed"
+
+	case BreakerOpen:
+		return "open"
+
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+
+	return fmt.Sprintf("BreakerState(%d)", int(this))
+}
+
+type BreakerOpt struct {
+	// The breaker opens when at least ErrorPercent of the requests within
+	// Window failed, provided there were at least RequestVolume of them.
+	Window        time.Duration
+	ErrorPercent  int
+	RequestVolume int
+
+	// MaxRequests short-circuits requests beyond that many concurrent
+	// requests or streams on the backend. 0 means unlimited.
+	MaxRequests int
+
+	// After OpenTimeout an open breaker lets HalfOpenRequests probes
+	// through; it closes once all of them succeeded and opens again on
+	// the first failure.
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+func (this BreakerOpt) withDefaults() BreakerOpt {
+	if this.Window <= 0 {
+		this.Window = 10 * time.Second
+	}
+
+	if this.ErrorPercent <= 0 {
+		this.ErrorPercent = 50
+	}
+
+	if this.RequestVolume <= 0 {
+		this.RequestVolume = 20
+	}
+
+	if this.OpenTimeout <= 0 {
+		this.OpenTimeout = 30 * time.Second
+	}
+
+	if this.HalfOpenRequests <= 0 {
+		this.HalfOpenRequests = 1
+	}
+
+	return this
+}
+
+func NewBreaker(name string, opt BreakerOpt) *Breaker {
+	return &Breaker{
+		name:        name,
+		opt:         opt.withDefaults(),
+		windowStart: time.Now(),
+	}
+}
+
+// Breaker is a per backend circuit breaker.
+type Breaker struct {
+	name string
+	opt  BreakerOpt
+
+	mu       sync.Mutex
+	state    BreakerState
+	openedAt time.Time
+	inflight int
+
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	probes    int
+	successes int
+}
+
+// State returns the current state, moving an expired open breaker to half-open.
+func (this *Breaker) State() BreakerState {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.tick(time.Now())
+	return this.state
+}
+
+// Available reports whether a request would currently be let through.
+func (this *Breaker) Available() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.tick(time.Now())
+
+	switch this.state {
+	case BreakerOpen:
+		return false
+
+	case BreakerHalfOpen:
+		return this.probes < this.opt.HalfOpenRequests
+	}
+
+	return this.opt.MaxRequests <= 0 || this.inflight < this.opt.MaxRequests
+}
+
+// allow reserves a slot for a request. Every successful call must be
+// paired with a call to done.
+func (this *Breaker) allow() (bool, string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.tick(time.Now())
+
+	switch this.state {
+	case BreakerOpen:
+		return false, "circuit breaker is open"
+
+	case BreakerHalfOpen:
+		if this.probes >= this.opt.HalfOpenRequests {
+			return false, "circuit breaker is half-open"
+		}
+
+		this.probes += 1
+	}
+
+	if this.opt.MaxRequests > 0 && this.inflight >= this.opt.MaxRequests {
+		if this.state == BreakerHalfOpen {
+			this.probes -= 1
+		}
+
+		return false, fmt.Sprintf("more than %d concurrent requests", this.opt.MaxRequests)
+	}
+
+	this.inflight += 1
+	return true, ""
+}
+
+func (this *Breaker) done(outcome Outcome) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	this.inflight -= 1
+	this.tick(now)
+
+	failed := outcome.Failed()
+
+	switch this.state {
+	case BreakerHalfOpen:
+		if failed {
+			this.open(now, "half-open probe failed")
+			return
+		}
+
+		this.successes += 1
+		if this.successes >= this.opt.HalfOpenRequests {
+			this.transit(BreakerClosed, fmt.Sprintf("%d half-open probes succeeded", this.successes))
+			this.windowStart = now
+			this.requests, this.failures = 0, 0
+		}
+
+	case BreakerClosed:
+		this.requests += 1
+		if failed {
+			this.failures += 1
+		}
+
+		if this.requests >= this.opt.RequestVolume && this.failures*100 >= this.opt.ErrorPercent*this.requests {
+			this.open(now, fmt.Sprintf("%d of %d requests failed within %s", this.failures, this.requests, this.opt.Window))
+		}
+	}
+}
+
+func (this *Breaker) tick(now time.Time) {
+	switch this.state {
+	case BreakerOpen:
+		if now.Sub(this.openedAt) >= this.opt.OpenTimeout {
+			this.probes, this.successes = 0, 0
+			this.transit(BreakerHalfOpen, fmt.Sprintf("open for %s", this.opt.OpenTimeout))
+		}
+
+	case BreakerClosed:
+		if now.Sub(this.windowStart) >= this.opt.Window {
+			this.windowStart = now
+			this.requests, this.failures = 0, 0
+		}
+	}
+}
+
+func (this *Breaker) open(now time.Time, reason string) {
+	this.openedAt = now
+	this.transit(BreakerOpen, reason)
+}
+
+func (this *Breaker) transit(state BreakerState, reason string) {
+	log.Printf("[BREAKER][%s] %s => %s: %s", this.name, this.state, state, reason)
+	this.state = state
+}
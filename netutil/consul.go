@@ -0,0 +1,309 @@
+package netutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ConsulIndexHeader carries the index blocking queries wait on.
+	ConsulIndexHeader = "X-Consul-Index"
+	ConsulTokenHeader = "X-Consul-Token"
+)
+
+type ConsulOpt struct {
+	// Address of the consul agent, "http://127.0.0.1:8500" by default.
+	Address string
+
+	// Service is the name of the service to watch, optionally narrowed to
+	// the instances having Tag, in Datacenter.
+	Service    string
+	Tag        string
+	Datacenter string
+	Token      string
+
+	// Wait is how long a blocking query may be held by consul before it
+	// returns unchanged.
+	Wait time.Duration
+
+	// RetryBase and RetryMax bound the exponential backoff after failed
+	// queries.
+	RetryBase time.Duration
+	RetryMax  time.Duration
+}
+
+func (this ConsulOpt) withDefaults() ConsulOpt {
+	if this.Address == "" {
+		this.Address = "http://127.0.0.1:8500"
+	}
+
+	if !strings.Contains(this.Address, "://") {
+		this.Address = "http://" + this.Address
+	}
+
+	this.Address = strings.TrimSuffix(this.Address, "/")
+
+	if this.Wait <= 0 {
+		this.Wait = 5 * time.Minute
+	}
+
+	if this.RetryBase <= 0 {
+		this.RetryBase = time.Second
+	}
+
+	if this.RetryMax < this.RetryBase {
+		this.RetryMax = 30 * this.RetryBase
+	}
+
+	return this
+}
+
+// NewConsulDiscovery watches the instances of opt.Service in the consul
+// health api, with blocking queries. Instances whose checks are critical
+// are reported unhealthy, those with warnings get their warning weight.
+func NewConsulDiscovery(opt ConsulOpt, update func([]Target)) (*ConsulDiscovery, error) {
+	opt = opt.withDefaults()
+
+	if opt.Service == "" {
+		return nil, fmt.Errorf("service required")
+	}
+
+	if _, err := url.Parse(opt.Address); err != nil {
+		return nil, fmt.Errorf("invalid address: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &ConsulDiscovery{
+		opt:    opt,
+		update: update,
+		client: &http.Client{
+			// consul adds up to wait / 16 of jitter to the wait
+			Timeout: opt.Wait + opt.Wait/16 + 10*time.Second,
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+type ConsulDiscovery struct {
+	opt    ConsulOpt
+	update func([]Target)
+	client *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	index uint64
+	last  []Target
+}
+
+// consulEntry is the part of a /v1/health/service entry we read.
+type consulEntry struct {
+	Node struct {
+		Address    string
+		Datacenter string
+	}
+
+	Service struct {
+		Address string
+		Port    int
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+			Warning int
+		}
+	}
+
+	Checks []struct {
+		Status string
+	}
+}
+
+// Refresh queries consul once, without blocking.
+func (this *ConsulDiscovery) Refresh() {
+	if err := this.watch(0); err != nil {
+		log.Printf("[CONSUL][%s] query failed, keeping the previous backends: %s", this.opt.Service, err)
+	}
+}
+
+// Run blocks on consul until Close is called, updating the targets every
+// time the service changes.
+func (this *ConsulDiscovery) Run() {
+	backoff := time.Duration(0)
+
+	for {
+		this.mu.Lock()
+		index := this.index
+		this.mu.Unlock()
+
+		err := this.watch(index)
+		if err == nil {
+			backoff = 0
+			continue
+		}
+
+		if this.ctx.Err() != nil {
+			return
+		}
+
+		if backoff *= 2; backoff < this.opt.RetryBase {
+			backoff = this.opt.RetryBase
+		}
+
+		if backoff > this.opt.RetryMax {
+			backoff = this.opt.RetryMax
+		}
+
+		log.Printf("[CONSUL][%s] query failed, retry in %s: %s", this.opt.Service, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-this.ctx.Done():
+			timer.Stop()
+			return
+
+		case <-timer.C:
+		}
+	}
+}
+
+// watch runs one query, blocking until the service changes past index if
+// index is set.
+func (this *ConsulDiscovery) watch(index uint64) error {
+	query := url.Values{}
+	if this.opt.Tag != "" {
+		query.Set("tag", this.opt.Tag)
+	}
+
+	if this.opt.Datacenter != "" {
+		query.Set("dc", this.opt.Datacenter)
+	}
+
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(this.opt.Wait/time.Second)))
+	}
+
+	req, err := http.NewRequestWithContext(this.ctx, http.MethodGet, this.opt.Address+"/v1/health/service/"+url.PathEscape(this.opt.Service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	if this.opt.Token != "" {
+		req.Header.Set(ConsulTokenHeader, this.opt.Token)
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return err
+	}
+
+	next, err := strconv.ParseUint(resp.Header.Get(ConsulIndexHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", ConsulIndexHeader, err)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// the index going backwards means consul lost its state, fetch it all
+	// again; an index of 0 never blocks, so it is clamped after a fetch
+	if next < this.index {
+		next = 0
+	} else if next == 0 {
+		next = 1
+	}
+
+	this.index = next
+
+	targets := consulTargets(entries)
+	if len(targets) == 0 {
+		log.Printf("[CONSUL][%s] no instances, keeping the previous backends", this.opt.Service)
+		return nil
+	}
+
+	SortTargets(targets)
+
+	if EqualTargets(targets, this.last) {
+		return nil
+	}
+
+	log.Printf("[CONSUL][%s] found %v", this.opt.Service, targets)
+
+	this.last = targets
+	this.update(targets)
+
+	return nil
+}
+
+func consulTargets(entries []consulEntry) []Target {
+	targets := make([]Target, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+
+		if host == "" || entry.Service.Port <= 0 {
+			continue
+		}
+
+		status := "passing"
+		for _, check := range entry.Checks {
+			switch check.Status {
+			case "critical", "maintenance":
+				status = "critical"
+
+			case "warning":
+				if status == "passing" {
+					status = "warning"
+				}
+			}
+		}
+
+		weight := entry.Service.Weights.Passing
+		if status == "warning" {
+			weight = entry.Service.Weights.Warning
+		}
+
+		if weight < 1 {
+			weight = 1
+		}
+
+		targets = append(targets, Target{
+			Addr:      net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+			Weight:    weight,
+			Unhealthy: status == "critical",
+			Zone:      entry.Node.Datacenter,
+			Metadata:  entry.Service.Meta,
+		})
+	}
+
+	return targets
+}
+
+func (this *ConsulDiscovery) Close() {
+	this.cancel()
+}
@@ -0,0 +1,286 @@
+package netutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// consulStub serves /v1/health/service/foo like a consul agent, holding
+// blocking queries until the index moves past theirs or wait elapses.
+type consulStub struct {
+	mu       sync.Mutex
+	index    uint64
+	entries  []map[string]interface{}
+	failures int
+	changed  chan struct{}
+	queries  []string
+	times    []time.Time
+}
+
+func newConsulStub(t *testing.T) (*consulStub, *httptest.Server) {
+	stub := &consulStub{
+		index:   1,
+		changed: make(chan struct{}),
+	}
+
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+
+	return stub, srv
+}
+
+func consulInstance(addr string, port int, statuses ...string) map[string]interface{} {
+	checks := make([]map[string]string, 0, len(statuses))
+	for _, status := range statuses {
+		checks = append(checks, map[string]string{"Status": status})
+	}
+
+	return map[string]interface{}{
+		"Node": map[string]string{"Address": addr, "Datacenter": "dc1"},
+		"Service": map[string]interface{}{
+			"Port":    port,
+			"Weights": map[string]int{"Passing": 10, "Warning": 1},
+		},
+		"Checks": checks,
+	}
+}
+
+// set replaces the instances and moves the index to index.
+func (this *consulStub) set(index uint64, entries ...map[string]interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.index = index
+	this.entries = entries
+
+	close(this.changed)
+	this.changed = make(chan struct{})
+}
+
+func (this *consulStub) fail(n int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.failures = n
+}
+
+func (this *consulStub) seen() ([]string, []time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]string(nil), this.queries...), append([]time.Time(nil), this.times...)
+}
+
+func (this *consulStub) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/health/service/foo" {
+		http.NotFound(rw, req)
+		return
+	}
+
+	this.mu.Lock()
+	this.queries = append(this.queries, req.URL.RawQuery)
+	this.times = append(this.times, time.Now())
+
+	if this.failures > 0 {
+		this.failures--
+		this.mu.Unlock()
+
+		http.Error(rw, "agent unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	changed := this.changed
+	current := this.index
+	this.mu.Unlock()
+
+	if index, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64); index > 0 && index >= current {
+		wait, _ := time.ParseDuration(req.URL.Query().Get("wait"))
+
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	rw.Header().Set(ConsulIndexHeader, strconv.FormatUint(this.index, 10))
+	json.NewEncoder(rw).Encode(this.entries)
+}
+
+func TestConsulDiscoveryStatus(t *testing.T) {
+	stub, srv := newConsulStub(t)
+	stub.set(5,
+		consulInstance("10.0.0.1", 8000, "passing", "passing"),
+		consulInstance("10.0.0.2", 8000, "passing", "warning"),
+		consulInstance("10.0.0.3", 8000, "warning", "critical"),
+		consulInstance("10.0.0.4", 8000, "maintenance"),
+	)
+
+	updates := &targetUpdates{}
+	discovery, err := NewConsulDiscovery(ConsulOpt{
+		Address: srv.URL,
+		Service: "foo",
+		Tag:     "v2",
+	}, updates.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer discovery.Close()
+
+	discovery.Refresh()
+
+	got := updates.all()
+	if len(got) != 1 {
+		t.Fatalf("updates = %v", got)
+	}
+
+	want := []Target{
+		{Addr: "10.0.0.1:8000", Weight: 10, Zone: "dc1"},
+		{Addr: "10.0.0.2:8000", Weight: 1, Zone: "dc1"},
+		{Addr: "10.0.0.3:8000", Weight: 10, Zone: "dc1", Unhealthy: true},
+		{Addr: "10.0.0.4:8000", Weight: 10, Zone: "dc1", Unhealthy: true},
+	}
+
+	if !EqualTargets(got[0], want) {
+		t.Fatalf("targets = %v, want %v", got[0], want)
+	}
+
+	queries, _ := stub.seen()
+	if queries[0] != "tag=v2" {
+		t.Fatalf("first query %q, want no index", queries[0])
+	}
+}
+
+func TestConsulDiscoveryBlocking(t *testing.T) {
+	stub, srv := newConsulStub(t)
+	stub.set(5, consulInstance("10.0.0.1", 8000, "passing"))
+
+	updates := &targetUpdates{}
+	discovery, err := NewConsulDiscovery(ConsulOpt{
+		Address: srv.URL,
+		Service: "foo",
+		Wait:    2 * time.Second,
+	}, updates.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer discovery.Close()
+
+	discovery.Refresh()
+	go discovery.Run()
+
+	// the watch blocks on the index of the previous answer
+	waitFor(t, func() bool {
+		queries, _ := stub.seen()
+		return len(queries) >= 2
+	})
+
+	queries, _ := stub.seen()
+	if queries[1] != "index=5&wait=2s" {
+		t.Fatalf("blocking query %q", queries[1])
+	}
+
+	stub.set(7, consulInstance("10.0.0.1", 8000, "passing"), consulInstance("10.0.0.2", 8000, "passing"))
+
+	waitFor(t, func() bool {
+		return len(updates.all()) == 2
+	})
+
+	if got := targetAddrs(updates.all()[1]); len(got) != 2 {
+		t.Fatalf("targets after change = %v", got)
+	}
+
+	waitFor(t, func() bool {
+		queries, _ := stub.seen()
+		return len(queries) >= 3 && queries[len(queries)-1] == "index=7&wait=2s"
+	})
+
+	// an index going backwards means consul lost its state: fetch it all
+	stub.set(3, consulInstance("10.0.0.3", 8000, "passing"))
+
+	waitFor(t, func() bool {
+		queries, _ := stub.seen()
+		return queries[len(queries)-1] == "index=3&wait=2s"
+	})
+
+	queries, _ = stub.seen()
+	if queries[len(queries)-2] != "" {
+		t.Fatalf("query after the index reset = %q, want a full fetch", queries[len(queries)-2])
+	}
+
+	// no instances keep the previous backends
+	n := len(updates.all())
+	stub.set(9)
+
+	waitFor(t, func() bool {
+		queries, _ := stub.seen()
+		return queries[len(queries)-1] == "index=9&wait=2s"
+	})
+
+	if got := updates.all(); len(got) != n {
+		t.Fatalf("updates after an empty answer = %v", got[n:])
+	}
+}
+
+func TestConsulDiscoveryBackoff(t *testing.T) {
+	stub, srv := newConsulStub(t)
+	stub.set(5, consulInstance("10.0.0.1", 8000, "passing"))
+
+	updates := &targetUpdates{}
+	discovery, err := NewConsulDiscovery(ConsulOpt{
+		Address:   srv.URL,
+		Service:   "foo",
+		RetryBase: 20 * time.Millisecond,
+		RetryMax:  80 * time.Millisecond,
+	}, updates.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer discovery.Close()
+
+	stub.fail(5)
+	go discovery.Run()
+
+	waitFor(t, func() bool {
+		return len(updates.all()) == 1
+	})
+
+	// the query after the one passing blocks
+	_, times := stub.seen()
+	if len(times) < 6 {
+		t.Fatalf("%d queries, want 5 failed and 1 passed", len(times))
+	}
+
+	// 20ms, 40ms, 80ms then capped at 80ms
+	for i, want := range []time.Duration{20, 40, 80, 80, 80} {
+		want *= time.Millisecond
+		if gap := times[i+1].Sub(times[i]); gap < want {
+			t.Fatalf("retry %d after %s, want at least %s", i+1, gap, want)
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within 5s")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,93 @@
+package netutil
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+)
+
+var (
+	_ Discovery = &DNSDiscovery{}
+	_ Discovery = &FileDiscovery{}
+	_ Discovery = &ConsulDiscovery{}
+	_ Discovery = &XDSDiscovery{}
+	_ Discovery = &KubeDiscovery{}
+)
+
+// Discovery watches the backends of a service and passes them, as
+// targets, to the update func it was built with whenever they change.
+type Discovery interface {
+	// Refresh looks the targets up once, and blocks until it is done.
+	Refresh()
+
+	// Run blocks and watches for changes until Close is called.
+	Run()
+
+	Close()
+}
+
+// Target is a backend address found by discovery. Targets of lower
+// Priority are preferred, see Priority. Unhealthy targets are known to the
+// source but failing its own checks, they are not to be balanced to. Zone
+// and Metadata describe the target as its source lists it.
+type Target struct {
+	Addr      string
+	Weight    int
+	Priority  int
+	Unhealthy bool
+	Zone      string
+	Metadata  map[string]string
+}
+
+func (this Target) String() string {
+	s := fmt.Sprintf("%s [W %d] [P %d]", this.Addr, this.Weight, this.Priority)
+	if this.Unhealthy {
+		s += " [UNHEALTHY]"
+	}
+
+	if this.Zone != "" {
+		s += fmt.Sprintf(" [Z %s]", this.Zone)
+	}
+
+	if len(this.Metadata) > 0 {
+		s += fmt.Sprintf(" %v", this.Metadata)
+	}
+
+	return s
+}
+
+func (this Target) equal(other Target) bool {
+	return this.Addr == other.Addr &&
+		this.Weight == other.Weight &&
+		this.Priority == other.Priority &&
+		this.Unhealthy == other.Unhealthy &&
+		this.Zone == other.Zone &&
+		maps.Equal(this.Metadata, other.Metadata)
+}
+
+// SortTargets orders targets by priority then address, so that two
+// resolutions of the same backends compare equal.
+func SortTargets(targets []Target) {
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Priority != targets[j].Priority {
+			return targets[i].Priority < targets[j].Priority
+		}
+
+		return targets[i].Addr < targets[j].Addr
+	})
+}
+
+// EqualTargets reports whether two sorted target lists are the same.
+func EqualTargets(a, b []Target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
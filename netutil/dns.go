@@ -0,0 +1,202 @@
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DNSOpt struct {
+	// Name is the host name to resolve, e.g. "foo.service.local", or the
+	// full SRV name, e.g. "_grpc._tcp.foo.service.local".
+	Name string
+
+	// SRV resolves SRV records instead of A / AAAA records. The addresses
+	// of SRV targets, resolved through the same server, keep the priority,
+	// weight and port of their record; A / AAAA addresses all get weight 1
+	// and Port.
+	SRV  bool
+	Port int
+
+	// Interval between resolutions, Timeout bounds each of them.
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// Server is the address of the dns server to query, e.g.
+	// "127.0.0.1:5353". The system resolver is used if empty.
+	Server string
+}
+
+func (this DNSOpt) withDefaults() DNSOpt {
+	if this.Interval <= 0 {
+		this.Interval = 30 * time.Second
+	}
+
+	if this.Timeout <= 0 {
+		this.Timeout = 5 * time.Second
+	}
+
+	return this
+}
+
+// NewDNSDiscovery resolves opt.Name every interval and passes the targets
+// to update whenever they differ from the previous resolution. Failed or
+// empty resolutions keep the previous targets.
+func NewDNSDiscovery(opt DNSOpt, update func([]Target)) (*DNSDiscovery, error) {
+	opt = opt.withDefaults()
+
+	if opt.Name == "" {
+		return nil, fmt.Errorf("name required")
+	}
+
+	if !opt.SRV && (opt.Port <= 0 || opt.Port > 65535) {
+		return nil, fmt.Errorf("port required for A / AAAA records")
+	}
+
+	resolver := net.DefaultResolver
+	if opt.Server != "" {
+		server := opt.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return &DNSDiscovery{
+		opt:      opt,
+		resolver: resolver,
+		update:   update,
+		closeCh:  make(chan struct{}),
+	}, nil
+}
+
+type DNSDiscovery struct {
+	opt      DNSOpt
+	resolver *net.Resolver
+	update   func([]Target)
+
+	mu   sync.Mutex
+	last []Target
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// Refresh resolves once and updates the targets if they changed.
+func (this *DNSDiscovery) Refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), this.opt.Timeout)
+	defer cancel()
+
+	targets, err := this.resolve(ctx)
+	if err == nil && len(targets) == 0 {
+		err = fmt.Errorf("no records")
+	}
+
+	if err != nil {
+		log.Printf("[DNS][%s] resolution failed, keeping the previous backends: %s", this.opt.Name, err)
+		return
+	}
+
+	SortTargets(targets)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if EqualTargets(targets, this.last) {
+		return
+	}
+
+	log.Printf("[DNS][%s] resolved %v", this.opt.Name, targets)
+
+	this.last = targets
+	this.update(targets)
+}
+
+func (this *DNSDiscovery) resolve(ctx context.Context) ([]Target, error) {
+	if this.opt.SRV {
+		_, records, err := this.resolver.LookupSRV(ctx, "", "", this.opt.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		targets := make([]Target, 0, len(records))
+		for _, record := range records {
+			weight := int(record.Weight)
+			if weight < 1 {
+				weight = 1
+			}
+
+			// targets are resolved here rather than by the transport, which
+			// would go through the system resolver instead of Server
+			host := strings.TrimSuffix(record.Target, ".")
+			addrs, err := this.resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+					log.Printf("[DNS][%s] skip srv target %s: %s", this.opt.Name, host, err)
+					continue
+				}
+
+				return nil, err
+			}
+
+			for _, addr := range addrs {
+				targets = append(targets, Target{
+					Addr:     net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(record.Port))),
+					Weight:   weight,
+					Priority: int(record.Priority),
+				})
+			}
+		}
+
+		return targets, nil
+	}
+
+	addrs, err := this.resolver.LookupIPAddr(ctx, this.opt.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]Target, 0, len(addrs))
+	for _, addr := range addrs {
+		targets = append(targets, Target{
+			Addr:   net.JoinHostPort(addr.IP.String(), strconv.Itoa(this.opt.Port)),
+			Weight: 1,
+		})
+	}
+
+	return targets, nil
+}
+
+// Run blocks and refreshes every interval until Close is called.
+func (this *DNSDiscovery) Run() {
+	ticker := time.NewTicker(this.opt.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.closeCh:
+			return
+
+		case <-ticker.C:
+			this.Refresh()
+		}
+	}
+}
+
+func (this *DNSDiscovery) Close() {
+	this.closeOnce.Do(func() {
+		close(this.closeCh)
+	})
+}
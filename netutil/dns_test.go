@@ -0,0 +1,317 @@
+package netutil
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsStub answers A and SRV queries over udp from the records it is
+// given, and fails every query while failing is set.
+type dnsStub struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	a       map[string][]net.IP
+	srv     map[string][]net.SRV
+	failing bool
+}
+
+func newDNSStub(t *testing.T) *dnsStub {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &dnsStub{
+		conn: conn,
+		a:    make(map[string][]net.IP),
+		srv:  make(map[string][]net.SRV),
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	go stub.serve()
+
+	return stub
+}
+
+func (this *dnsStub) addr() string {
+	return this.conn.LocalAddr().String()
+}
+
+func (this *dnsStub) set(fn func(stub *dnsStub)) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	fn(this)
+}
+
+func (this *dnsStub) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := this.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		question, err := parser.Question()
+		if err != nil {
+			continue
+		}
+
+		resp, err := this.answer(header, question)
+		if err != nil {
+			continue
+		}
+
+		this.conn.WriteTo(resp, from)
+	}
+}
+
+func (this *dnsStub) answer(header dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	name := strings.ToLower(question.Name.String())
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:            header.ID,
+		Response:      true,
+		Authoritative: true,
+		RCode:         dnsmessage.RCodeSuccess,
+	})
+
+	if this.failing {
+		builder = dnsmessage.NewBuilder(nil, dnsmessage.Header{
+			ID:       header.ID,
+			Response: true,
+			RCode:    dnsmessage.RCodeServerFailure,
+		})
+	}
+
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	rh := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   1,
+	}
+
+	if !this.failing {
+		switch question.Type {
+		case dnsmessage.TypeA:
+			for _, ip := range this.a[name] {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip.To4())
+
+				if err := builder.AResource(rh, a); err != nil {
+					return nil, err
+				}
+			}
+
+		case dnsmessage.TypeSRV:
+			for _, srv := range this.srv[name] {
+				target, err := dnsmessage.NewName(srv.Target)
+				if err != nil {
+					return nil, err
+				}
+
+				err = builder.SRVResource(rh, dnsmessage.SRVResource{
+					Priority: srv.Priority,
+					Weight:   srv.Weight,
+					Port:     srv.Port,
+					Target:   target,
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return builder.Finish()
+}
+
+// targetUpdates collects the targets a discovery reports.
+type targetUpdates struct {
+	mu      sync.Mutex
+	updates [][]Target
+}
+
+func (this *targetUpdates) update(targets []Target) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.updates = append(this.updates, targets)
+}
+
+func (this *targetUpdates) all() [][]Target {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.updates
+}
+
+func targetAddrs(targets []Target) []string {
+	out := make([]string, 0, len(targets))
+	for _, target := range targets {
+		out = append(out, target.Addr)
+	}
+
+	return out
+}
+
+func TestDNSDiscoveryA(t *testing.T) {
+	stub := newDNSStub(t)
+	stub.set(func(stub *dnsStub) {
+		stub.a["foo.service.local."] = []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")}
+	})
+
+	updates := &targetUpdates{}
+	discovery, err := NewDNSDiscovery(DNSOpt{
+		Name:   "foo.service.local.",
+		Port:   8000,
+		Server: stub.addr(),
+	}, updates.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discovery.Refresh()
+	discovery.Refresh()
+
+	got := updates.all()
+	if len(got) != 1 || strings.Join(targetAddrs(got[0]), ",") != "10.0.0.1:8000,10.0.0.2:8000" {
+		t.Fatalf("updates = %v", got)
+	}
+
+	// a changed record set is reported on the next refresh
+	stub.set(func(stub *dnsStub) {
+		stub.a["foo.service.local."] = []net.IP{net.ParseIP("10.0.0.3")}
+	})
+
+	discovery.Refresh()
+
+	got = updates.all()
+	if len(got) != 2 || strings.Join(targetAddrs(got[1]), ",") != "10.0.0.3:8000" {
+		t.Fatalf("updates = %v", got)
+	}
+
+	// failures and empty answers keep the previous backends
+	stub.set(func(stub *dnsStub) {
+		stub.failing = true
+	})
+
+	discovery.Refresh()
+
+	stub.set(func(stub *dnsStub) {
+		stub.failing = false
+		delete(stub.a, "foo.service.local.")
+	})
+
+	discovery.Refresh()
+
+	if got = updates.all(); len(got) != 2 {
+		t.Fatalf("updates after failed resolutions = %v", got)
+	}
+}
+
+func TestDNSDiscoverySRV(t *testing.T) {
+	stub := newDNSStub(t)
+	stub.set(func(stub *dnsStub) {
+		stub.srv["_grpc._tcp.foo.service.local."] = []net.SRV{
+			{Target: "a.foo.service.local.", Port: 8001, Priority: 0, Weight: 10},
+			{Target: "b.foo.service.local.", Port: 8002, Priority: 1, Weight: 0},
+		}
+		stub.a["a.foo.service.local."] = []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+		stub.a["b.foo.service.local."] = []net.IP{net.ParseIP("10.0.0.3")}
+	})
+
+	updates := &targetUpdates{}
+	discovery, err := NewDNSDiscovery(DNSOpt{
+		Name:   "_grpc._tcp.foo.service.local.",
+		SRV:    true,
+		Server: stub.addr(),
+	}, updates.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discovery.Refresh()
+
+	got := updates.all()
+	if len(got) != 1 {
+		t.Fatalf("updates = %v", got)
+	}
+
+	// targets are resolved through the stub, every address keeping the
+	// priority and weight of its record
+	want := []Target{
+		{Addr: "10.0.0.1:8001", Weight: 10, Priority: 0},
+		{Addr: "10.0.0.2:8001", Weight: 10, Priority: 0},
+		{Addr: "10.0.0.3:8002", Weight: 1, Priority: 1},
+	}
+
+	if !EqualTargets(got[0], want) {
+		t.Fatalf("targets = %v, want %v", got[0], want)
+	}
+
+	stub.set(func(stub *dnsStub) {
+		stub.srv["_grpc._tcp.foo.service.local."] = stub.srv["_grpc._tcp.foo.service.local."][:1]
+	})
+
+	discovery.Refresh()
+
+	got = updates.all()
+	if len(got) != 2 || !EqualTargets(got[1], want[:2]) {
+		t.Fatalf("updates = %v", got)
+	}
+
+	// a target without addresses is skipped
+	stub.set(func(stub *dnsStub) {
+		stub.srv["_grpc._tcp.foo.service.local."] = append(stub.srv["_grpc._tcp.foo.service.local."], net.SRV{
+			Target: "gone.foo.service.local.", Port: 8003, Priority: 0, Weight: 10,
+		})
+	})
+
+	discovery.Refresh()
+
+	if got = updates.all(); len(got) != 2 {
+		t.Fatalf("updates after a target without addresses = %v", got)
+	}
+
+	stub.set(func(stub *dnsStub) {
+		stub.failing = true
+	})
+
+	discovery.Refresh()
+
+	if got = updates.all(); len(got) != 2 {
+		t.Fatalf("updates after a failed resolution = %v", got)
+	}
+}
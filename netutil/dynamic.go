@@ -0,0 +1,68 @@
+package netutil
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	_ Balancer = &DynamicBalancer{}
+)
+
+// Dynamic returns a balancer whose underlying balancer, and so its backend
+// set, can be swapped while it serves requests. Until the first Swap it
+// answers every request with UNAVAILABLE.
+func Dynamic() *DynamicBalancer {
+	return &DynamicBalancer{}
+}
+
+type DynamicBalancer struct {
+	current atomic.Value
+}
+
+type dynamicState struct {
+	balancer Balancer
+}
+
+func (this *DynamicBalancer) Pick(req *http.Request) http.Handler {
+	if state, ok := this.current.Load().(dynamicState); ok && state.balancer != nil {
+		return state.balancer.Pick(req)
+	}
+
+	return noBackends
+}
+
+// Swap makes balancer serve all requests picked from now on. Requests
+// already picked carry on with the backends they got.
+func (this *DynamicBalancer) Swap(balancer Balancer) {
+	this.current.Store(dynamicState{
+		balancer: balancer,
+	})
+}
+
+// Current returns the balancer in use, nil if none is.
+func (this *DynamicBalancer) Current() Balancer {
+	state, _ := this.current.Load().(dynamicState)
+	return state.balancer
+}
+
+func (this *DynamicBalancer) String() string {
+	if balancer := this.Current(); balancer != nil {
+		return fmt.Sprintf("[DYNAMIC] %v", balancer)
+	}
+
+	return "[DYNAMIC] no backends"
+}
+
+// noBackends is a pointer rather than a func, handlers get compared by
+// Retry and Hedge.
+var noBackends = &noBackendsHandler{}
+
+type noBackendsHandler struct{}
+
+func (this *noBackendsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	WriteError(rw, req, http.StatusServiceUnavailable, codes.Unavailable, "no backends discovered")
+}
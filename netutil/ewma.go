@@ -0,0 +1,181 @@
+package netutil
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	_ Balancer = &reversePeakEWMA{}
+	_ Observer = &reversePeakEWMA{}
+)
+
+type PeakEWMAOpt struct {
+	// Decay is the time it takes for an old latency sample to lose most
+	// of its influence.
+	Decay time.Duration
+
+	// FailurePenalty is the latency recorded for a failed request so that
+	// a backend failing fast doesn't look attractive.
+	FailurePenalty time.Duration
+
+	// DefaultLatency is what backends are assumed to take before their
+	// first response, so that a new backend doesn't draw all the traffic.
+	DefaultLatency time.Duration
+}
+
+func (this PeakEWMAOpt) withDefaults() PeakEWMAOpt {
+	if this.Decay <= 0 {
+		this.Decay = 10 * time.Second
+	}
+
+	if this.FailurePenalty <= 0 {
+		this.FailurePenalty = time.Second
+	}
+
+	if this.DefaultLatency <= 0 {
+		this.DefaultLatency = 100 * time.Millisecond
+	}
+
+	return this
+}
+
+// ewma is a peak sensitive moving average: a sample above the current
+// value replaces it at once, lower samples only pull it down over time.
+// The first sample replaces the seed whatever its value.
+type ewma struct {
+	value    float64
+	stamp    time.Time
+	observed bool
+}
+
+func newEWMA(now time.Time, seed float64) ewma {
+	return ewma{
+		value: seed,
+		stamp: now,
+	}
+}
+
+func (this *ewma) observe(now time.Time, sample float64, decay time.Duration) {
+	if !this.observed || sample > this.value {
+		this.value = sample
+	} else {
+		w := this.weight(now, decay)
+		this.value = this.value*w + sample*(1-w)
+	}
+
+	this.stamp = now
+	this.observed = true
+}
+
+// current is the value decayed towards 0 for the time elapsed since the
+// last sample, so that a backend penalized once, and left aside since,
+// gets picked again.
+func (this *ewma) current(now time.Time, decay time.Duration) float64 {
+	return this.value * this.weight(now, decay)
+}
+
+func (this *ewma) weight(now time.Time, decay time.Duration) float64 {
+	elapsed := now.Sub(this.stamp)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	return math.Exp(-float64(elapsed) / float64(decay))
+}
+
+type ewmaStats struct {
+	header  ewma
+	trailer ewma
+}
+
+// PeakEWMA picks the cheaper of two random backends, the cost being the
+// peak EWMA of the time to response headers times the requests in flight.
+// The EWMA decays towards 0 while a backend gets no response, so that
+// backends left aside after a failure or a slow response are retried.
+// The time to trailers is tracked as well and shows up in the balancer's
+// description. It needs to be attached to its backends to learn latencies.
+func PeakEWMA(backends []*ReverseProxyBackend, opt PeakEWMAOpt) (*reversePeakEWMA, error) {
+	if len(backends) == 0 {
+		return nil, errBackendsRequired
+	}
+
+	opt = opt.withDefaults()
+	now := time.Now()
+
+	stats := make(map[*ReverseProxyBackend]*ewmaStats, len(backends))
+	for _, backend := range backends {
+		stats[backend] = &ewmaStats{
+			header:  newEWMA(now, float64(opt.DefaultLatency)),
+			trailer: newEWMA(now, float64(opt.DefaultLatency)),
+		}
+	}
+
+	return &reversePeakEWMA{
+		backends: backends,
+		opt:      opt,
+		stats:    stats,
+	}, nil
+}
+
+type reversePeakEWMA struct {
+	backends []*ReverseProxyBackend
+	opt      PeakEWMAOpt
+
+	mu    sync.Mutex
+	stats map[*ReverseProxyBackend]*ewmaStats
+}
+
+func (this *reversePeakEWMA) Pick(req *http.Request) http.Handler {
+	a, b := twoRandom(this.backends)
+	if this.cost(b) < this.cost(a) {
+		return b
+	}
+
+	return a
+}
+
+func (this *reversePeakEWMA) Observe(backend *ReverseProxyBackend, outcome Outcome) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	st, ok := this.stats[backend]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	header, trailer := outcome.HeaderDuration, outcome.Duration
+	if outcome.Failed() || header == 0 {
+		header, trailer = this.opt.FailurePenalty, this.opt.FailurePenalty
+	}
+
+	st.header.observe(now, float64(header), this.opt.Decay)
+	st.trailer.observe(now, float64(trailer), this.opt.Decay)
+}
+
+func (this *reversePeakEWMA) cost(backend *ReverseProxyBackend) float64 {
+	this.mu.Lock()
+	latency := this.stats[backend].header.current(time.Now(), this.opt.Decay)
+	this.mu.Unlock()
+
+	return latency * float64(backend.InFlight()+1)
+}
+
+func (this *reversePeakEWMA) String() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	latencies := make([]string, 0, len(this.backends))
+	for _, backend := range this.backends {
+		st := this.stats[backend]
+		header, trailer := st.header.current(now, this.opt.Decay), st.trailer.current(now, this.opt.Decay)
+		latencies = append(latencies, fmt.Sprintf("%s %s/%s", backend.rawBack, time.Duration(header), time.Duration(trailer)))
+	}
+
+	return fmt.Sprintf("[PEAK EWMA] %d backends, decay %s, latency %v", len(this.backends), this.opt.Decay, latencies)
+}
@@ -0,0 +1,75 @@
+package netutil
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func ewmaPicks(balancer *reversePeakEWMA, n int) map[*ReverseProxyBackend]int {
+	picks := make(map[*ReverseProxyBackend]int)
+	for i := 0; i < n; i++ {
+		picks[balancer.Pick(nil).(*ReverseProxyBackend)]++
+	}
+
+	return picks
+}
+
+func TestPeakEWMADefaultLatency(t *testing.T) {
+	backends := testBackends(t, 2)
+
+	balancer, err := PeakEWMA(backends, PeakEWMAOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancer.Observe(backends[0], Outcome{HeaderDuration: 10 * time.Millisecond, Duration: 10 * time.Millisecond})
+
+	// the backend without a response yet is assumed to take 100ms
+	if picks := ewmaPicks(balancer, 100); picks[backends[1]] != 0 {
+		t.Fatalf("the new backend was picked %d times over the faster one", picks[backends[1]])
+	}
+
+	fresh, err := PeakEWMA(backends, PeakEWMAOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if picks := ewmaPicks(fresh, 1000); picks[backends[0]] == 0 || picks[backends[1]] == 0 {
+		t.Fatalf("new backends aren't both picked: %v", picks)
+	}
+}
+
+func TestPeakEWMAPenaltyDecays(t *testing.T) {
+	backends := testBackends(t, 2)
+	penalized, healthy := backends[0], backends[1]
+
+	balancer, err := PeakEWMA(backends, PeakEWMAOpt{
+		Decay:          50 * time.Millisecond,
+		FailurePenalty: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := Outcome{HeaderDuration: time.Millisecond, Duration: time.Millisecond}
+
+	balancer.Observe(penalized, Outcome{Err: errors.New("connection refused")})
+	balancer.Observe(healthy, ok)
+
+	if picks := ewmaPicks(balancer, 100); picks[penalized] != 0 {
+		t.Fatalf("the penalized backend was picked %d times right after its failure", picks[penalized])
+	}
+
+	// the healthy backend keeps serving while the penalty decays, after
+	// about decay * ln(1s / 1ms), 350ms, the penalized one is picked again
+	start := time.Now()
+	waitFor(t, func() bool {
+		balancer.Observe(healthy, ok)
+		return ewmaPicks(balancer, 10)[penalized] > 0
+	})
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("the penalized backend was picked again after %s", elapsed)
+	}
+}
@@ -0,0 +1,99 @@
+package netutil
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+type FaultOpt struct {
+	// Delay holds DelayPercent of the requests back before they are
+	// proxied.
+	Delay        time.Duration
+	DelayPercent float64
+
+	// AbortPercent of the requests are answered with AbortCode and
+	// AbortMessage instead of being proxied, or with AbortStatus for non
+	// grpc requests.
+	AbortCode    codes.Code
+	AbortMessage string
+	AbortStatus  int
+	AbortPercent float64
+
+	// Header limits faults to requests carrying it, if set.
+	Header string
+}
+
+func (this FaultOpt) withDefaults() FaultOpt {
+	if this.AbortStatus <= 0 {
+		this.AbortStatus = http.StatusServiceUnavailable
+	}
+
+	if this.AbortMessage == "" {
+		this.AbortMessage = "fault injected"
+	}
+
+	if this.Header != "" {
+		this.Header = http.CanonicalHeaderKey(this.Header)
+	}
+
+	return this
+}
+
+func NewFault(opt FaultOpt) *Fault {
+	return &Fault{
+		opt: opt.withDefaults(),
+	}
+}
+
+// Fault delays or aborts requests to test how clients cope with a slow
+// or failing service. Delayed requests may be aborted as well.
+type Fault struct {
+	opt FaultOpt
+}
+
+// Inject applies the faults picked for req. It reports whether req has
+// been answered already, because it was aborted or its context ended
+// while delayed.
+func (this *Fault) Inject(rw http.ResponseWriter, req *http.Request) bool {
+	if this.opt.Header != "" {
+		if _, ok := req.Header[this.opt.Header]; !ok {
+			return false
+		}
+	}
+
+	if this.opt.Delay > 0 && sample(this.opt.DelayPercent) {
+		log.Printf("[FAULT][%s] %s delayed %s", req.Method, req.URL, this.opt.Delay)
+
+		timer := time.NewTimer(this.opt.Delay)
+		select {
+		case <-timer.C:
+
+		case <-req.Context().Done():
+			timer.Stop()
+			WriteContextError(rw, req, req.Context().Err())
+			return true
+		}
+	}
+
+	if sample(this.opt.AbortPercent) {
+		log.Printf("[FAULT][%s] %s aborted with %s", req.Method, req.URL, this.opt.AbortCode)
+		WriteError(rw, req, this.opt.AbortStatus, this.opt.AbortCode, this.opt.AbortMessage)
+		return true
+	}
+
+	return false
+}
+
+func (this *Fault) String() string {
+	return fmt.Sprintf("[FAULT] delay %s for %g%%, abort with %s for %g%%", this.opt.Delay, this.opt.DelayPercent, this.opt.AbortCode, this.opt.AbortPercent)
+}
+
+// sample reports true for percent out of every 100 calls on average.
+func sample(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
@@ -0,0 +1,224 @@
+package netutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.yaml.in/yaml/v3"
+)
+
+// fileSettle is how long the file has to stay unchanged before it is read,
+// so that a burst of writes is read once.
+const fileSettle = 100 * time.Millisecond
+
+// FileEntry is one backend listed in a discovery file.
+//
+//	[
+//	    {"address": "10.0.0.1:8000", "weight": 10, "zone": "a", "metadata": {"version": "v2"}},
+//	    {"address": "10.0.0.2:8000", "priority": 1}
+//	]
+type FileEntry struct {
+	Address  string            `json:"address" yaml:"address"`
+	Weight   int               `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Priority int               `json:"priority,omitempty" yaml:"priority,omitempty"`
+	Zone     string            `json:"zone,omitempty" yaml:"zone,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+type FileOpt struct {
+	Path string
+
+	// Format is either "json" or "yaml", guessed from the extension of
+	// Path if empty.
+	Format string
+}
+
+func (this FileOpt) withDefaults() FileOpt {
+	if this.Format == "" {
+		switch strings.ToLower(filepath.Ext(this.Path)) {
+		case ".yaml", ".yml":
+			this.Format = "yaml"
+
+		default:
+			this.Format = "json"
+		}
+	}
+
+	return this
+}
+
+// NewFileDiscovery reads the backends listed in opt.Path, and reads them
+// again whenever its directory changes, which covers files replaced by a
+// rename or through a symlink. Files which can't be read, fail to parse or
+// list no backends keep the previous targets.
+func NewFileDiscovery(opt FileOpt, update func([]Target)) (*FileDiscovery, error) {
+	opt = opt.withDefaults()
+
+	if opt.Path == "" {
+		return nil, fmt.Errorf("path required")
+	}
+
+	if opt.Format != "json" && opt.Format != "yaml" {
+		return nil, fmt.Errorf("unknown format %q, expected json or yaml", opt.Format)
+	}
+
+	path, err := filepath.Abs(opt.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	opt.Path = path
+
+	// watch the directory rather than the file, which deploy tools tend
+	// to replace by renaming a new one over it
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	return &FileDiscovery{
+		opt:     opt,
+		watcher: watcher,
+		update:  update,
+	}, nil
+}
+
+type FileDiscovery struct {
+	opt     FileOpt
+	watcher *fsnotify.Watcher
+	update  func([]Target)
+
+	mu   sync.Mutex
+	last []Target
+}
+
+// Refresh reads the file once and updates the targets if they changed.
+func (this *FileDiscovery) Refresh() {
+	targets, err := this.read()
+	if err != nil {
+		log.Printf("[FILE][%s] read failed, keeping the previous backends: %s", this.opt.Path, err)
+		return
+	}
+
+	SortTargets(targets)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if EqualTargets(targets, this.last) {
+		return
+	}
+
+	log.Printf("[FILE][%s] loaded %v", this.opt.Path, targets)
+
+	this.last = targets
+	this.update(targets)
+}
+
+func (this *FileDiscovery) read() ([]Target, error) {
+	data, err := ioutil.ReadFile(this.opt.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []FileEntry
+	if this.opt.Format == "yaml" {
+		err = yaml.Unmarshal(data, &entries)
+	} else {
+		err = json.Unmarshal(data, &entries)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no backends")
+	}
+
+	seen := make(map[string]bool, len(entries))
+	targets := make([]Target, 0, len(entries))
+
+	for i, entry := range entries {
+		addr := strings.TrimSpace(entry.Address)
+		if addr == "" {
+			return nil, fmt.Errorf("entry #%d: address required", i)
+		}
+
+		if seen[addr] {
+			return nil, fmt.Errorf("entry #%d: duplicate address %q", i, addr)
+		}
+
+		if entry.Weight < 0 {
+			return nil, fmt.Errorf("entry #%d: negative weight", i)
+		}
+
+		if entry.Weight == 0 {
+			entry.Weight = 1
+		}
+
+		seen[addr] = true
+		targets = append(targets, Target{
+			Addr:     addr,
+			Weight:   entry.Weight,
+			Priority: entry.Priority,
+			Zone:     entry.Zone,
+			Metadata: entry.Metadata,
+		})
+	}
+
+	return targets, nil
+}
+
+// Run blocks and reads the file again once it settles after a change,
+// until Close is called.
+func (this *FileDiscovery) Run() {
+	settle := time.NewTimer(fileSettle)
+	settle.Stop()
+
+	for {
+		select {
+		case event, ok := <-this.watcher.Events:
+			if !ok {
+				settle.Stop()
+				return
+			}
+
+			// any change in the directory may change the file: kubernetes
+			// updates configmap volumes by swapping the "..data" symlink
+			// the file points through, without an event on the file
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			settle.Reset(fileSettle)
+
+		case err, ok := <-this.watcher.Errors:
+			if !ok {
+				settle.Stop()
+				return
+			}
+
+			log.Printf("[FILE][%s] watch error: %s", this.opt.Path, err)
+
+		case <-settle.C:
+			this.Refresh()
+		}
+	}
+}
+
+func (this *FileDiscovery) Close() {
+	this.watcher.Close()
+}
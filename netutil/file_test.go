@@ -0,0 +1,179 @@
+package netutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestFileDiscovery(t *testing.T, path string) (*FileDiscovery, *targetUpdates) {
+	t.Helper()
+
+	updates := &targetUpdates{}
+	discovery, err := NewFileDiscovery(FileOpt{Path: path}, updates.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(discovery.Close)
+
+	return discovery, updates
+}
+
+func TestFileDiscoveryFormats(t *testing.T) {
+	dir := t.TempDir()
+
+	want := []Target{
+		{Addr: "10.0.0.1:8000", Weight: 10, Zone: "a", Metadata: map[string]string{"version": "v2"}},
+		{Addr: "10.0.0.2:8000", Weight: 1, Priority: 1},
+	}
+
+	for name, content := range map[string]string{
+		"backends.json": `[
+    {"address": "10.0.0.2:8000", "priority": 1},
+    {"address": "10.0.0.1:8000", "weight": 10, "zone": "a", "metadata": {"version": "v2"}}
+]`,
+		"backends.yaml": `
+- address: 10.0.0.2:8000
+  priority: 1
+- address: 10.0.0.1:8000
+  weight: 10
+  zone: a
+  metadata:
+    version: v2
+`,
+	} {
+		path := filepath.Join(dir, name)
+		writeFile(t, path, content)
+
+		discovery, updates := newTestFileDiscovery(t, path)
+		discovery.Refresh()
+
+		got := updates.all()
+		if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+			t.Errorf("%s: updates = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestFileDiscoveryInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.json")
+	writeFile(t, path, `[{"address": "10.0.0.1:8000"}]`)
+
+	discovery, updates := newTestFileDiscovery(t, path)
+	discovery.Refresh()
+
+	for _, content := range []string{
+		`[{"address": "10.0.0.2:8000"`,
+		`[]`,
+		`[{"address": ""}]`,
+		`[{"address": "10.0.0.2:8000"}, {"address": "10.0.0.2:8000"}]`,
+		`[{"address": "10.0.0.2:8000", "weight": -1}]`,
+	} {
+		writeFile(t, path, content)
+		discovery.Refresh()
+	}
+
+	os.Remove(path)
+	discovery.Refresh()
+
+	got := updates.all()
+	if len(got) != 1 || !reflect.DeepEqual(targetAddrs(got[0]), []string{"10.0.0.1:8000"}) {
+		t.Fatalf("updates = %v", got)
+	}
+}
+
+// runFileDiscovery watches path and returns a func waiting for the targets
+// to be addrs.
+func runFileDiscovery(t *testing.T, path string) func(addrs ...string) {
+	t.Helper()
+
+	discovery, updates := newTestFileDiscovery(t, path)
+	discovery.Refresh()
+
+	go discovery.Run()
+
+	return func(addrs ...string) {
+		t.Helper()
+
+		waitFor(t, func() bool {
+			got := updates.all()
+			return len(got) > 0 && reflect.DeepEqual(targetAddrs(got[len(got)-1]), addrs)
+		})
+	}
+}
+
+func TestFileDiscoveryWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backends.json")
+	writeFile(t, path, `[{"address": "10.0.0.1:8000"}]`)
+
+	waitTargets := runFileDiscovery(t, path)
+	waitTargets("10.0.0.1:8000")
+
+	writeFile(t, path, `[{"address": "10.0.0.2:8000"}]`)
+	waitTargets("10.0.0.2:8000")
+
+	// renamed over the file, as deploy tools do
+	tmp := filepath.Join(dir, ".backends.json.tmp")
+	writeFile(t, tmp, `[{"address": "10.0.0.3:8000"}]`)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	waitTargets("10.0.0.3:8000")
+}
+
+func TestFileDiscoveryConfigMap(t *testing.T) {
+	// the layout of a configmap volume: the file links through "..data",
+	// a link to the directory holding the current version
+	dir := t.TempDir()
+
+	version := func(name, content string) {
+		t.Helper()
+
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		writeFile(t, filepath.Join(dir, name, "backends.json"), content)
+	}
+
+	version("..v1", `[{"address": "10.0.0.1:8000"}]`)
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "backends.json")
+	if err := os.Symlink(filepath.Join("..data", "backends.json"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	waitTargets := runFileDiscovery(t, path)
+	waitTargets("10.0.0.1:8000")
+
+	// an update swaps "..data", the file itself is left alone
+	version("..v2", `[{"address": "10.0.0.2:8000"}]`)
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, "..v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitTargets("10.0.0.2:8000")
+}
@@ -0,0 +1,62 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+// IsGRPCRequest reports whether the request was sent by a grpc client.
+func IsGRPCRequest(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// WriteError answers a grpc request with a trailers-only response carrying
+// code and msg, and any other request with a plain http status.
+func WriteError(rw http.ResponseWriter, req *http.Request, status int, code codes.Code, msg string) {
+	if !IsGRPCRequest(req) {
+		http.Error(rw, msg, status)
+		return
+	}
+
+	h := rw.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(int(code)))
+	if msg != "" {
+		h.Set("Grpc-Message", encodeGRPCMessage(msg))
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// WriteContextError answers a request whose context ended before any
+// backend response could be forwarded.
+func WriteContextError(rw http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		WriteError(rw, req, http.StatusGatewayTimeout, codes.DeadlineExceeded, "deadline exceeded")
+		return
+	}
+
+	WriteError(rw, req, http.StatusBadGateway, codes.Canceled, "request canceled")
+}
+
+// encodeGRPCMessage percent-encodes msg as required for the grpc-message header.
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,263 @@
+package netutil
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	_ Balancer = &reverseRingHash{}
+	_ Balancer = &reverseMaglev{}
+)
+
+const (
+	// ringPointsPerWeight is the number of virtual nodes a backend of weight 1
+	// gets on the ring.
+	ringPointsPerWeight = 160
+
+	// maglevTableSize must be prime and much larger than the number of backends.
+	maglevTableSize = 65537
+)
+
+// HashKey extracts the value hashing balancers route on.
+type HashKey func(req *http.Request) string
+
+// ParseHashKey parses a hash key spec:
+//
+//	"ip"                client address, honoring X-Forwarded-For (default)
+//	"authority"         request host
+//	"path"              request path, i.e. the grpc full method name
+//	"header:<name>"     request header or grpc metadata, client address if absent
+func ParseHashKey(spec string) (HashKey, error) {
+	spec = strings.TrimSpace(spec)
+
+	switch spec {
+	case "", "ip":
+		return ClientIP, nil
+
+	case "authority":
+		return func(req *http.Request) string {
+			return req.Host
+		}, nil
+
+	case "path":
+		return func(req *http.Request) string {
+			return req.URL.Path
+		}, nil
+	}
+
+	if name := strings.TrimPrefix(spec, "header:"); name != spec && name != "" {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		return func(req *http.Request) string {
+			if value := req.Header.Get(name); value != "" {
+				return value
+			}
+
+			return ClientIP(req)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown hash key %q", spec)
+}
+
+// ClientIP returns the address of the original client: the first
+// X-Forwarded-For entry if any, the connection's remote address otherwise.
+func ClientIP(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		if idx := strings.IndexByte(xff, ','); idx >= 0 {
+			xff = xff[:idx]
+		}
+
+		if ip := strings.TrimSpace(xff); ip != "" {
+			return ip
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+
+	return req.RemoteAddr
+}
+
+// hash64 is fnv-1a followed by a 64 bit finalizer so that similar inputs,
+// like virtual node names, spread evenly.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *ReverseProxyBackend
+}
+
+// RingHash is a ketama style consistent hashing balancer: every backend
+// owns Weight * 160 points on a ring, and a key goes to the owner of the
+// first point at or after its hash.
+func RingHash(backends []*ReverseProxyBackend, key HashKey) (*reverseRingHash, error) {
+	if len(backends) == 0 {
+		return nil, errBackendsRequired
+	}
+
+	ring := make([]ringPoint, 0, len(backends)*ringPointsPerWeight)
+	for _, backend := range backends {
+		for i := 0; i < backend.Weight()*ringPointsPerWeight; i++ {
+			ring = append(ring, ringPoint{
+				hash:    hash64(backend.rawBack + "-" + strconv.Itoa(i)),
+				backend: backend,
+			})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	return &reverseRingHash{
+		backends: backends,
+		key:      key,
+		ring:     ring,
+	}, nil
+}
+
+type reverseRingHash struct {
+	backends []*ReverseProxyBackend
+	key      HashKey
+	ring     []ringPoint
+}
+
+func (this *reverseRingHash) Pick(req *http.Request) http.Handler {
+	if len(this.backends) == 1 {
+		return this.backends[0]
+	}
+
+	h := hash64(this.key(req))
+	idx := sort.Search(len(this.ring), func(i int) bool {
+		return this.ring[i].hash >= h
+	})
+
+	// walk clockwise past unavailable backends
+	for i := 0; i < len(this.ring); i++ {
+		if b := this.ring[(idx+i)%len(this.ring)].backend; b.Available() {
+			return b
+		}
+	}
+
+	return this.ring[idx%len(this.ring)].backend
+}
+
+func (this *reverseRingHash) String() string {
+	return fmt.Sprintf("[RING HASH] %d backends, %d points", len(this.backends), len(this.ring))
+}
+
+// Maglev builds a maglev lookup table in which every backend fills slots
+// in proportion to its Weight.
+func Maglev(backends []*ReverseProxyBackend, key HashKey) (*reverseMaglev, error) {
+	if len(backends) == 0 {
+		return nil, errBackendsRequired
+	}
+
+	const size = maglevTableSize
+
+	type entry struct {
+		offset uint64
+		skip   uint64
+		next   uint64
+		target int
+	}
+
+	entries := make([]entry, len(backends))
+	weights := make([]int, len(backends))
+	maxWeight := 0
+	for i, backend := range backends {
+		entries[i] = entry{
+			offset: hash64(backend.rawBack+"-offset") % size,
+			skip:   hash64(backend.rawBack+"-skip")%(size-1) + 1,
+		}
+
+		weights[i] = backend.Weight()
+		if weights[i] > maxWeight {
+			maxWeight = weights[i]
+		}
+	}
+
+	table := make([]*ReverseProxyBackend, size)
+	filled := 0
+
+	for iteration := 1; filled < size; iteration++ {
+		for i := 0; i < len(entries) && filled < size; i++ {
+			e := &entries[i]
+
+			// a backend of weight maxWeight / n only fills a slot every n iterations
+			if iteration*weights[i] < e.target {
+				continue
+			}
+
+			e.target += maxWeight
+
+			c := (e.offset + e.skip*e.next) % size
+			for table[c] != nil {
+				e.next += 1
+				c = (e.offset + e.skip*e.next) % size
+			}
+
+			table[c] = backends[i]
+			e.next += 1
+			filled += 1
+		}
+	}
+
+	return &reverseMaglev{
+		backends: backends,
+		key:      key,
+		table:    table,
+	}, nil
+}
+
+type reverseMaglev struct {
+	backends []*ReverseProxyBackend
+	key      HashKey
+	table    []*ReverseProxyBackend
+}
+
+func (this *reverseMaglev) Pick(req *http.Request) http.Handler {
+	if len(this.backends) == 1 {
+		return this.backends[0]
+	}
+
+	h := hash64(this.key(req))
+	size := uint64(len(this.table))
+	b := this.table[h%size]
+	if b.Available() {
+		return b
+	}
+
+	// probe a key specific sequence of slots, so that only the keys of the
+	// unavailable backend move
+	step := (h>>32)%(size-1) + 1
+	for i := uint64(1); i <= 2*uint64(len(this.backends)); i++ {
+		if one := this.table[(h+i*step)%size]; one.Available() {
+			return one
+		}
+	}
+
+	return pickWeighted(available(this.backends))
+}
+
+func (this *reverseMaglev) String() string {
+	return fmt.Sprintf("[MAGLEV] %d backends, table size %d", len(this.backends), len(this.table))
+}
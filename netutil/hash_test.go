@@ -0,0 +1,165 @@
+package netutil
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testBackends(t *testing.T, n int) []*ReverseProxyBackend {
+	t.Helper()
+
+	backends := make([]*ReverseProxyBackend, 0, n)
+	for i := 0; i < n; i++ {
+		raw := fmt.Sprintf("http://10.0.0.%d:8000", i+1)
+
+		target, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		backends = append(backends, NewReverseProxyBackend(raw, target, 1, http.DefaultTransport))
+	}
+
+	return backends
+}
+
+type hashBuilder func([]*ReverseProxyBackend, HashKey) (Balancer, error)
+
+var hashBalancers = map[string]hashBuilder{
+	"ring_hash": func(backends []*ReverseProxyBackend, key HashKey) (Balancer, error) {
+		return RingHash(backends, key)
+	},
+	"maglev": func(backends []*ReverseProxyBackend, key HashKey) (Balancer, error) {
+		return Maglev(backends, key)
+	},
+}
+
+const hashKeys = 10000
+
+// hashPicks maps every test key to the address of the backend it goes to.
+func hashPicks(t *testing.T, build hashBuilder, backends []*ReverseProxyBackend) []string {
+	t.Helper()
+
+	key, err := ParseHashKey("header:x-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancer, err := build(backends, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	picks := make([]string, hashKeys)
+	for i := range picks {
+		req := httptest.NewRequest(http.MethodPost, "/rpc.Foo/Bar", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+
+		picks[i] = balancer.Pick(req).(*ReverseProxyBackend).rawBack
+	}
+
+	return picks
+}
+
+func TestHashRemapOnAdd(t *testing.T) {
+	for name, build := range hashBalancers {
+		t.Run(name, func(t *testing.T) {
+			backends := testBackends(t, 5)
+
+			before := hashPicks(t, build, backends[:4])
+			after := hashPicks(t, build, backends)
+
+			added := backends[4].rawBack
+			moved, misplaced := 0, 0
+			for i := range before {
+				if before[i] == after[i] {
+					continue
+				}
+
+				moved++
+				if after[i] != added {
+					misplaced++
+				}
+			}
+
+			// ideally 1/5 of the keys move, all of them to the new backend
+			if fraction := float64(moved) / hashKeys; fraction < 0.1 || fraction > 0.3 {
+				t.Fatalf("%d/%d keys moved", moved, hashKeys)
+			}
+
+			if misplaced > hashKeys/100 {
+				t.Fatalf("%d/%d keys moved between the old backends", misplaced, hashKeys)
+			}
+		})
+	}
+}
+
+func TestHashRemapOnRemove(t *testing.T) {
+	for name, build := range hashBalancers {
+		t.Run(name, func(t *testing.T) {
+			backends := testBackends(t, 5)
+
+			before := hashPicks(t, build, backends)
+			after := hashPicks(t, build, append(backends[:2:2], backends[3:]...))
+
+			removed := backends[2].rawBack
+			orphans, moved := 0, 0
+			for i := range before {
+				if before[i] == removed {
+					orphans++
+					continue
+				}
+
+				if before[i] != after[i] {
+					moved++
+				}
+			}
+
+			if orphans == 0 {
+				t.Fatalf("no key went to the removed backend")
+			}
+
+			// only the keys of the removed backend should move
+			if moved > hashKeys/100 {
+				t.Fatalf("%d/%d keys of the remaining backends moved", moved, hashKeys)
+			}
+		})
+	}
+}
+
+func TestHashKeyStable(t *testing.T) {
+	for name, build := range hashBalancers {
+		t.Run(name, func(t *testing.T) {
+			key, err := ParseHashKey("header:x-session")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			balancer, err := build(testBackends(t, 5), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for session := 0; session < 100; session++ {
+				var first http.Handler
+
+				// the same metadata from different clients lands on the same backend
+				for client := 0; client < 10; client++ {
+					req := httptest.NewRequest(http.MethodPost, "/rpc.Foo/Bar", nil)
+					req.RemoteAddr = fmt.Sprintf("192.168.0.%d:4000", client+1)
+					req.Header.Set("X-Session", fmt.Sprintf("session-%d", session))
+
+					picked := balancer.Pick(req)
+					if first == nil {
+						first = picked
+					} else if picked != first {
+						t.Fatalf("session-%d picked %s then %s", session, first, picked)
+					}
+				}
+			}
+		})
+	}
+}
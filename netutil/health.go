@@ -0,0 +1,191 @@
+package netutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const healthCheckPath = "/grpc.health.v1.Health/Check"
+
+type HealthCheckOpt struct {
+	Interval           time.Duration
+	Timeout            time.Duration
+	UnhealthyThreshold int
+	HealthyThreshold   int
+	Service            string
+}
+
+func (this HealthCheckOpt) withDefaults() HealthCheckOpt {
+	if this.Interval <= 0 {
+		this.Interval = 5 * time.Second
+	}
+
+	if this.Timeout <= 0 {
+		this.Timeout = time.Second
+	}
+
+	if this.UnhealthyThreshold <= 0 {
+		this.UnhealthyThreshold = 3
+	}
+
+	if this.HealthyThreshold <= 0 {
+		this.HealthyThreshold = 2
+	}
+
+	return this
+}
+
+// NewHealthChecker returns a checker which periodically calls
+// grpc.health.v1.Health/Check on the backend through its own transport.
+func NewHealthChecker(backend *ReverseProxyBackend, opt HealthCheckOpt) *HealthChecker {
+	return &HealthChecker{
+		backend: backend,
+		opt:     opt.withDefaults(),
+		closeCh: make(chan struct{}),
+	}
+}
+
+type HealthChecker struct {
+	backend *ReverseProxyBackend
+	opt     HealthCheckOpt
+
+	successes int
+	failures  int
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// Run blocks and checks the backend every interval until Close is called.
+func (this *HealthChecker) Run() {
+	ticker := time.NewTicker(this.opt.Interval)
+	defer ticker.Stop()
+
+	for {
+		this.check()
+
+		select {
+		case <-this.closeCh:
+			return
+
+		case <-ticker.C:
+
+		}
+	}
+}
+
+func (this *HealthChecker) Close() {
+	this.closeOnce.Do(func() {
+		close(this.closeCh)
+	})
+}
+
+func (this *HealthChecker) check() {
+	err := this.probe()
+	if err == nil {
+		this.failures = 0
+		this.successes += 1
+
+		if this.successes >= this.opt.HealthyThreshold {
+			this.backend.setHealthy(true, fmt.Sprintf("%d consecutive health checks passed", this.successes))
+		}
+
+		return
+	}
+
+	this.successes = 0
+	this.failures += 1
+
+	if this.failures >= this.opt.UnhealthyThreshold {
+		this.backend.setHealthy(false, fmt.Sprintf("%d consecutive health checks failed, last error: %s", this.failures, err))
+	}
+}
+
+func (this *HealthChecker) probe() error {
+	msg, err := proto.Marshal(&healthpb.HealthCheckRequest{
+		Service: this.opt.Service,
+	})
+	if err != nil {
+		return err
+	}
+
+	body := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:5], uint32(len(msg)))
+	copy(body[5:], msg)
+
+	target := *this.backend.target
+	target.Path = strings.TrimSuffix(target.Path, "/") + healthCheckPath
+
+	ctx, cancel := context.WithTimeout(context.Background(), this.opt.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := this.backend.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+
+	if status != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = resp.Header.Get("Grpc-Message")
+		}
+
+		return fmt.Errorf("grpc status %q: %s", status, message)
+	}
+
+	if len(data) < 5 {
+		return io.ErrUnexpectedEOF
+	}
+
+	size := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < size {
+		return io.ErrUnexpectedEOF
+	}
+
+	res := &healthpb.HealthCheckResponse{}
+	if err := proto.Unmarshal(data[5:5+size], res); err != nil {
+		return err
+	}
+
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("serving status %s", res.Status)
+	}
+
+	return nil
+}
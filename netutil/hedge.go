@@ -0,0 +1,274 @@
+package netutil
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+type HedgeOpt struct {
+	// Methods lists the full method names, e.g. "/rpc.Foo/Chat", which
+	// are idempotent and therefore safe to hedge.
+	Methods []string
+
+	// Delay after which another copy of the request is sent if no
+	// response has arrived yet.
+	Delay time.Duration
+
+	// MaxAttempts includes the original request.
+	MaxAttempts int
+
+	// NonFatal lists grpc status codes which don't end the call while
+	// other attempts are pending; the next copy is sent right away instead.
+	// Responses without grpc status are non-fatal on http 502, 503 and 504.
+	NonFatal []codes.Code
+
+	// MaxBufferSize is the number of request body bytes kept for the
+	// hedged copies. Larger requests are not hedged any further, and only
+	// the attempt which read past the buffer keeps sending its body, the
+	// others are cancelled.
+	MaxBufferSize int
+}
+
+func (this HedgeOpt) withDefaults() HedgeOpt {
+	if this.Delay <= 0 {
+		this.Delay = 50 * time.Millisecond
+	}
+
+	if this.MaxAttempts <= 0 {
+		this.MaxAttempts = 2
+	}
+
+	if len(this.NonFatal) == 0 {
+		this.NonFatal = []codes.Code{codes.Unavailable}
+	}
+
+	if this.MaxBufferSize <= 0 {
+		this.MaxBufferSize = 64 << 10
+	}
+
+	return this
+}
+
+func NewHedge(opt HedgeOpt) *Hedge {
+	opt = opt.withDefaults()
+
+	methods := make(map[string]bool, len(opt.Methods))
+	for _, m := range opt.Methods {
+		methods[m] = true
+	}
+
+	return &Hedge{
+		opt:     opt,
+		methods: methods,
+	}
+}
+
+// Hedge races copies of a request against several backends and forwards
+// whichever response arrives first.
+type Hedge struct {
+	opt     HedgeOpt
+	methods map[string]bool
+}
+
+// Match reports whether the request may be hedged.
+func (this *Hedge) Match(req *http.Request) bool {
+	if !this.methods[req.URL.Path] {
+		return false
+	}
+
+	if IsGRPCRequest(req) {
+		return true
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+type hedgeAttempt struct {
+	w      *attemptWriter
+	cancel context.CancelFunc
+	panic  interface{}
+}
+
+// hedgeGroup elects the attempt whose response is sent to the client.
+type hedgeGroup struct {
+	hedge *Hedge
+	body  *replayBody
+
+	mu       sync.Mutex
+	attempts []*hedgeAttempt
+	running  int
+	winner   *hedgeAttempt
+}
+
+func (this *hedgeGroup) decide(a *hedgeAttempt, status int, header http.Header) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.winner != nil {
+		return true
+	}
+
+	more := len(this.attempts) < this.hedge.opt.MaxAttempts && this.body.replayable()
+	if this.hedge.nonFatal(status, header) && (this.running > 1 || more) {
+		return true
+	}
+
+	this.winner = a
+	for _, one := range this.attempts {
+		if one != a {
+			one.cancel()
+		}
+	}
+
+	return false
+}
+
+func (this *hedgeGroup) canLaunch() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.winner == nil && len(this.attempts) < this.hedge.opt.MaxAttempts && this.body.replayable()
+}
+
+func (this *Hedge) Serve(balancer Balancer, rw http.ResponseWriter, req *http.Request) {
+	group := &hedgeGroup{
+		hedge: this,
+		body:  newReplayBody(req.Body, this.opt.MaxBufferSize),
+	}
+
+	tried := make(map[http.Handler]bool, this.opt.MaxAttempts)
+	done := make(chan *hedgeAttempt, this.opt.MaxAttempts)
+
+	launch := func() {
+		h := pickUntried(balancer, req, tried)
+		tried[h] = true
+
+		ctx, cancel := context.WithCancel(req.Context())
+		a := &hedgeAttempt{
+			cancel: cancel,
+		}
+
+		a.w = newAttemptWriter(rw, func(status int, header http.Header) bool {
+			return group.decide(a, status, header)
+		})
+
+		group.mu.Lock()
+		group.attempts = append(group.attempts, a)
+		group.running += 1
+		n := len(group.attempts)
+		group.mu.Unlock()
+
+		if n > 1 {
+			log.Printf("[HEDGE][%s] %s sending attempt %d/%d", req.Method, req.URL, n, this.opt.MaxAttempts)
+		}
+
+		r := &hedgeBody{
+			ReadCloser: group.body.reader(),
+			cancel:     cancel,
+		}
+
+		areq := req.WithContext(ctx)
+		areq.Body = r
+
+		go func() {
+			defer func() {
+				a.panic = recover()
+				r.Close()
+				cancel()
+
+				group.mu.Lock()
+				group.running -= 1
+				group.mu.Unlock()
+
+				done <- a
+			}()
+
+			h.ServeHTTP(a.w, areq)
+		}()
+	}
+
+	launch()
+	pending := 1
+
+	timer := time.NewTimer(this.opt.Delay)
+	defer timer.Stop()
+
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if group.canLaunch() {
+				launch()
+				pending += 1
+				timer.Reset(this.opt.Delay)
+			}
+
+		case a := <-done:
+			pending -= 1
+
+			if a.w.Discarded() && group.canLaunch() {
+				launch()
+				pending += 1
+			}
+		}
+	}
+
+	group.mu.Lock()
+	winner := group.winner
+	group.mu.Unlock()
+
+	if winner == nil {
+		WriteError(rw, req, http.StatusBadGateway, codes.Unavailable, "all hedged attempts failed")
+		return
+	}
+
+	if winner.panic != nil {
+		panic(winner.panic)
+	}
+}
+
+// hedgeBody cancels its attempt once the body it sends can't be read any
+// further, the rest of it going to the attempt which outgrew the buffer.
+type hedgeBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (this *hedgeBody) Read(p []byte) (int, error) {
+	n, err := this.ReadCloser.Read(p)
+	if err == errReplayOverflow {
+		this.cancel()
+	}
+
+	return n, err
+}
+
+func (this *Hedge) nonFatal(status int, header http.Header) bool {
+	if header.Get("Grpc-Status") == "" {
+		switch status {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+
+		return false
+	}
+
+	code := grpcCode(header)
+	for _, one := range this.opt.NonFatal {
+		if code == one {
+			return true
+		}
+	}
+
+	return false
+}
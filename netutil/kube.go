@@ -0,0 +1,413 @@
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewKubeClient connects to the api server described by the kubeconfig
+// file, or to the one of the cluster the proxy runs in if kubeconfig is
+// empty.
+func NewKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	var (
+		cfg *rest.Config
+		err error
+	)
+
+	if kubeconfig == "" {
+		cfg, err = rest.InClusterConfig()
+	} else {
+		cfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(cfg)
+}
+
+type KubeOpt struct {
+	// Service is the name of the service whose endpoint slices are
+	// watched, in Namespace, "default" if empty.
+	Service   string
+	Namespace string
+
+	// PortName, or Port, picks the service port to proxy to. Port is the
+	// port of the service, not that of its pods; it is mapped to the name
+	// of the service port, which endpoint slices list their ports under,
+	// when the discovery starts. Both may be left empty for services with
+	// a single port.
+	PortName string
+	Port     int
+
+	// Timeout bounds the wait for the first listing of the slices.
+	Timeout time.Duration
+
+	// Resync is how often the slices are listed again, on top of watching
+	// them. 0 disables it.
+	Resync time.Duration
+}
+
+func (this KubeOpt) withDefaults() KubeOpt {
+	if this.Namespace == "" {
+		this.Namespace = metav1.NamespaceDefault
+	}
+
+	if this.Timeout <= 0 {
+		this.Timeout = 10 * time.Second
+	}
+
+	return this
+}
+
+// NewKubeDiscovery watches the endpoint slices of opt.Service through
+// client. Ready endpoints are reported healthy, the others unhealthy so
+// that the requests they serve drain. Terminating endpoints which still
+// serve are only reported healthy while no endpoint is ready.
+func NewKubeDiscovery(client kubernetes.Interface, opt KubeOpt, update func([]Target)) (*KubeDiscovery, error) {
+	opt = opt.withDefaults()
+
+	if opt.Service == "" {
+		return nil, fmt.Errorf("service required")
+	}
+
+	if opt.PortName != "" && opt.Port != 0 {
+		return nil, fmt.Errorf("port and port name can't be combined")
+	}
+
+	if opt.Port < 0 || opt.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", opt.Port)
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{
+		discoveryv1.LabelServiceName: opt.Service,
+	})
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, opt.Resync,
+		informers.WithNamespace(opt.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = selector.String()
+		}),
+	)
+
+	slices := factory.Discovery().V1().EndpointSlices()
+
+	this := &KubeDiscovery{
+		opt:      opt,
+		update:   update,
+		client:   client,
+		factory:  factory,
+		informer: slices.Informer(),
+		lister:   slices.Lister(),
+		selector: selector,
+		stopCh:   make(chan struct{}),
+
+		portName:  opt.PortName,
+		portKnown: opt.Port == 0,
+	}
+
+	_, err := this.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) {
+			this.changed()
+		},
+		UpdateFunc: func(interface{}, interface{}) {
+			this.changed()
+		},
+		DeleteFunc: func(interface{}) {
+			this.changed()
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+type KubeDiscovery struct {
+	opt      KubeOpt
+	update   func([]Target)
+	client   kubernetes.Interface
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	lister   listersv1.EndpointSliceLister
+	selector labels.Selector
+
+	mu   sync.Mutex
+	last []Target
+
+	// portName is the name of the service port, once opt.Port is mapped
+	portName  string
+	portKnown bool
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	stopCh    chan struct{}
+}
+
+// Refresh starts watching the slices, once the port is known, and waits
+// for them to be listed.
+func (this *KubeDiscovery) Refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), this.opt.Timeout)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-this.stopCh:
+			cancel()
+
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := this.lookupPort(ctx); err != nil {
+		log.Printf("[KUBE][%s/%s] port %d: %s", this.opt.Namespace, this.opt.Service, this.opt.Port, err)
+		return
+	}
+
+	this.startOnce.Do(func() {
+		this.factory.Start(this.stopCh)
+	})
+
+	// events report the slices once they are listed, if that takes longer
+	if !cache.WaitForCacheSync(ctx.Done(), this.informer.HasSynced) {
+		log.Printf("[KUBE][%s/%s] endpoint slices not listed within %s", this.opt.Namespace, this.opt.Service, this.opt.Timeout)
+		return
+	}
+
+	this.changed()
+}
+
+// lookupPort maps opt.Port to the name of the service port, unless done
+// already.
+func (this *KubeDiscovery) lookupPort(ctx context.Context) error {
+	this.mu.Lock()
+	known := this.portKnown
+	this.mu.Unlock()
+
+	if known {
+		return nil
+	}
+
+	service, err := this.client.CoreV1().Services(this.opt.Namespace).Get(ctx, this.opt.Service, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, port := range service.Spec.Ports {
+		if int(port.Port) != this.opt.Port {
+			continue
+		}
+
+		log.Printf("[KUBE][%s/%s] port %d is named %q, targets %s", this.opt.Namespace, this.opt.Service, port.Port, port.Name, port.TargetPort.String())
+
+		this.mu.Lock()
+		this.portName = port.Name
+		this.portKnown = true
+		this.mu.Unlock()
+
+		return nil
+	}
+
+	return fmt.Errorf("no such service port")
+}
+
+// changed reports the endpoints of the slices, once they were listed.
+func (this *KubeDiscovery) changed() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if !this.portKnown || !this.informer.HasSynced() {
+		return
+	}
+
+	slices, err := this.lister.EndpointSlices(this.opt.Namespace).List(this.selector)
+	if err != nil {
+		log.Printf("[KUBE][%s/%s] list failed, keeping the previous backends: %s", this.opt.Namespace, this.opt.Service, err)
+		return
+	}
+
+	targets := kubeTargets(slices, this.portName, this.opt.PortName != "" || this.opt.Port != 0)
+	if len(targets) == 0 {
+		log.Printf("[KUBE][%s/%s] no endpoints on port %q, keeping the previous backends", this.opt.Namespace, this.opt.Service, this.portName)
+		return
+	}
+
+	SortTargets(targets)
+
+	if EqualTargets(targets, this.last) {
+		return
+	}
+
+	log.Printf("[KUBE][%s/%s] found %v", this.opt.Namespace, this.opt.Service, targets)
+
+	this.last = targets
+	this.update(targets)
+}
+
+// Run blocks until Close is called, updates come from the informer. It
+// retries to look the port up until it succeeds.
+func (this *KubeDiscovery) Run() {
+	ticker := time.NewTicker(this.opt.Timeout)
+	defer ticker.Stop()
+
+	for {
+		this.mu.Lock()
+		known := this.portKnown
+		this.mu.Unlock()
+
+		if known {
+			break
+		}
+
+		select {
+		case <-this.stopCh:
+			return
+
+		case <-ticker.C:
+			this.Refresh()
+		}
+	}
+
+	<-this.stopCh
+}
+
+func (this *KubeDiscovery) Close() {
+	this.closeOnce.Do(func() {
+		close(this.stopCh)
+		this.factory.Shutdown()
+	})
+}
+
+// kubeTargets lists the endpoints of slices on the port named port, or on
+// their only port unless named. An endpoint listed by several slices, as
+// happens while they are rebalanced, is listed once, ready if any slice
+// says so.
+func kubeTargets(slices []*discoveryv1.EndpointSlice, port string, named bool) []Target {
+	byAddr := make(map[string]Target)
+	ready := 0
+
+	for _, slice := range slices {
+		number, ok := kubePort(slice, port, named)
+		if !ok {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			conditions := endpoint.Conditions
+
+			// a nil condition is to be read as ready and serving
+			isReady := conditions.Ready == nil || *conditions.Ready
+			isServing := conditions.Serving == nil || *conditions.Serving
+			isTerminating := conditions.Terminating != nil && *conditions.Terminating
+
+			metadata := make(map[string]string)
+			if endpoint.NodeName != nil {
+				metadata["node"] = *endpoint.NodeName
+			}
+
+			if endpoint.TargetRef != nil {
+				metadata["pod"] = endpoint.TargetRef.Name
+			}
+
+			for _, address := range endpoint.Addresses {
+				target := Target{
+					Addr:      net.JoinHostPort(address, strconv.Itoa(int(number))),
+					Weight:    1,
+					Unhealthy: !isReady,
+					Metadata:  metadata,
+				}
+
+				if endpoint.Zone != nil {
+					target.Zone = *endpoint.Zone
+				}
+
+				// terminating endpoints which still serve are kept apart
+				// until it is known whether any endpoint is ready
+				if isTerminating && isServing {
+					target.Metadata = kubeTerminating(metadata)
+				}
+
+				if prev, ok := byAddr[target.Addr]; ok && !prev.Unhealthy {
+					continue
+				}
+
+				byAddr[target.Addr] = target
+			}
+		}
+	}
+
+	for _, target := range byAddr {
+		if !target.Unhealthy {
+			ready++
+		}
+	}
+
+	targets := make([]Target, 0, len(byAddr))
+	for _, target := range byAddr {
+		if _, ok := target.Metadata[kubeTerminatingKey]; ok && ready == 0 {
+			target.Unhealthy = false
+		}
+
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// kubeTerminatingKey marks, in their metadata, the terminating endpoints
+// which still serve.
+const kubeTerminatingKey = "terminating"
+
+func kubeTerminating(metadata map[string]string) map[string]string {
+	marked := make(map[string]string, len(metadata)+1)
+	for key, value := range metadata {
+		marked[key] = value
+	}
+
+	marked[kubeTerminatingKey] = "true"
+	return marked
+}
+
+// kubePort returns the number, on the endpoints, of the port of slice
+// named port, or of its only port unless named. Slices name their ports
+// after those of the service, the unnamed port of a single port service
+// having an empty name.
+func kubePort(slice *discoveryv1.EndpointSlice, port string, named bool) (int32, bool) {
+	if !named {
+		if len(slice.Ports) == 1 && slice.Ports[0].Port != nil {
+			return *slice.Ports[0].Port, true
+		}
+
+		return 0, false
+	}
+
+	for _, one := range slice.Ports {
+		name := ""
+		if one.Name != nil {
+			name = *one.Name
+		}
+
+		if one.Port != nil && name == port {
+			return *one.Port, true
+		}
+	}
+
+	return 0, false
+}
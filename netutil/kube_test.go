@@ -0,0 +1,404 @@
+package netutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func kubeBool(v bool) *bool {
+	return &v
+}
+
+func kubeString(v string) *string {
+	return &v
+}
+
+func kubePortOf(name string, port int32) discoveryv1.EndpointPort {
+	one := discoveryv1.EndpointPort{
+		Port: &port,
+	}
+
+	if name != "" {
+		one.Name = kubeString(name)
+	}
+
+	return one
+}
+
+func kubeEndpoint(addr string, ready, serving, terminating *bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses: []string{addr},
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       ready,
+			Serving:     serving,
+			Terminating: terminating,
+		},
+		NodeName:  kubeString("node-1"),
+		Zone:      kubeString("z1"),
+		TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "pod-" + addr},
+	}
+}
+
+func kubeSlice(name string, ports []discoveryv1.EndpointPort, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "prod",
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: "foo",
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       ports,
+		Endpoints:   endpoints,
+	}
+}
+
+// kubeState reduces targets to address and health.
+func kubeState(targets []Target) map[string]bool {
+	state := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		state[target.Addr] = !target.Unhealthy
+	}
+
+	return state
+}
+
+func sameState(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for addr, healthy := range a {
+		if other, ok := b[addr]; !ok || other != healthy {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestKubeTargetsConditions(t *testing.T) {
+	ports := []discoveryv1.EndpointPort{kubePortOf("grpc", 8080)}
+
+	slice := kubeSlice("foo-a", ports,
+		kubeEndpoint("10.0.0.1", nil, nil, nil),
+		kubeEndpoint("10.0.0.2", kubeBool(true), kubeBool(true), kubeBool(false)),
+		kubeEndpoint("10.0.0.3", kubeBool(false), kubeBool(false), kubeBool(false)),
+		kubeEndpoint("10.0.0.4", kubeBool(false), kubeBool(true), kubeBool(true)),
+		kubeEndpoint("10.0.0.5", kubeBool(false), kubeBool(false), kubeBool(true)),
+	)
+
+	targets := kubeTargets([]*discoveryv1.EndpointSlice{slice}, "grpc", true)
+
+	want := map[string]bool{
+		"10.0.0.1:8080": true,
+		"10.0.0.2:8080": true,
+		"10.0.0.3:8080": false,
+		"10.0.0.4:8080": false,
+		"10.0.0.5:8080": false,
+	}
+
+	if got := kubeState(targets); !sameState(got, want) {
+		t.Fatalf("targets = %v, want %v", got, want)
+	}
+
+	for _, target := range targets {
+		if target.Zone != "z1" || target.Metadata["node"] != "node-1" || target.Metadata["pod"] != "pod-"+target.Addr[:len(target.Addr)-5] {
+			t.Fatalf("target %v lacks its zone or metadata", target)
+		}
+	}
+}
+
+func TestKubeTargetsTerminatingFallback(t *testing.T) {
+	ports := []discoveryv1.EndpointPort{kubePortOf("", 8080)}
+
+	// terminating endpoints still serving are used while none is ready
+	slice := kubeSlice("foo-a", ports,
+		kubeEndpoint("10.0.0.1", kubeBool(false), kubeBool(true), kubeBool(true)),
+		kubeEndpoint("10.0.0.2", kubeBool(false), kubeBool(false), kubeBool(true)),
+		kubeEndpoint("10.0.0.3", kubeBool(false), kubeBool(false), kubeBool(false)),
+	)
+
+	want := map[string]bool{
+		"10.0.0.1:8080": true,
+		"10.0.0.2:8080": false,
+		"10.0.0.3:8080": false,
+	}
+
+	if got := kubeState(kubeTargets([]*discoveryv1.EndpointSlice{slice}, "", false)); !sameState(got, want) {
+		t.Fatalf("targets = %v, want %v", got, want)
+	}
+}
+
+func TestKubeTargetsAcrossSlices(t *testing.T) {
+	ports := []discoveryv1.EndpointPort{kubePortOf("grpc", 8080)}
+
+	// an endpoint moving between slices is listed once, ready if either
+	// slice says so
+	slices := []*discoveryv1.EndpointSlice{
+		kubeSlice("foo-a", ports,
+			kubeEndpoint("10.0.0.1", kubeBool(false), kubeBool(false), nil),
+			kubeEndpoint("10.0.0.2", kubeBool(true), nil, nil),
+		),
+		kubeSlice("foo-b", ports,
+			kubeEndpoint("10.0.0.1", kubeBool(true), nil, nil),
+			kubeEndpoint("10.0.0.2", kubeBool(false), kubeBool(false), nil),
+			kubeEndpoint("10.0.0.3", kubeBool(true), nil, nil),
+		),
+	}
+
+	targets := kubeTargets(slices, "grpc", true)
+	if len(targets) != 3 {
+		t.Fatalf("targets = %v, want 3", targets)
+	}
+
+	want := map[string]bool{
+		"10.0.0.1:8080": true,
+		"10.0.0.2:8080": true,
+		"10.0.0.3:8080": true,
+	}
+
+	if got := kubeState(targets); !sameState(got, want) {
+		t.Fatalf("targets = %v, want %v", got, want)
+	}
+}
+
+func TestKubeTargetsPort(t *testing.T) {
+	multi := kubeSlice("foo-a", []discoveryv1.EndpointPort{kubePortOf("grpc", 8080), kubePortOf("metrics", 9090)},
+		kubeEndpoint("10.0.0.1", nil, nil, nil),
+	)
+
+	single := kubeSlice("bar-a", []discoveryv1.EndpointPort{kubePortOf("", 8080)},
+		kubeEndpoint("10.0.0.2", nil, nil, nil),
+	)
+
+	cases := []struct {
+		slice *discoveryv1.EndpointSlice
+		port  string
+		named bool
+		want  string
+	}{
+		{multi, "grpc", true, "10.0.0.1:8080"},
+		{multi, "metrics", true, "10.0.0.1:9090"},
+		{multi, "8080", true, ""},
+		{multi, "", false, ""},
+		{single, "", false, "10.0.0.2:8080"},
+		{single, "", true, "10.0.0.2:8080"},
+		{single, "grpc", true, ""},
+	}
+
+	for _, c := range cases {
+		targets := kubeTargets([]*discoveryv1.EndpointSlice{c.slice}, c.port, c.named)
+
+		got := ""
+		if len(targets) > 0 {
+			got = targets[0].Addr
+		}
+
+		if got != c.want {
+			t.Errorf("slice %s port %q named %v: got %q, want %q", c.slice.Name, c.port, c.named, got, c.want)
+		}
+	}
+}
+
+func kubeService(ports ...corev1.ServicePort) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "prod",
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: ports,
+		},
+	}
+}
+
+func TestKubeDiscovery(t *testing.T) {
+	ports := []discoveryv1.EndpointPort{kubePortOf("grpc", 8080), kubePortOf("metrics", 9090)}
+
+	client := fake.NewClientset(
+		kubeService(
+			corev1.ServicePort{Name: "grpc", Port: 80, TargetPort: intstr.FromInt32(8080)},
+			corev1.ServicePort{Name: "metrics", Port: 9000, TargetPort: intstr.FromString("metrics")},
+		),
+		kubeSlice("foo-a", ports,
+			kubeEndpoint("10.0.0.1", kubeBool(true), nil, nil),
+		),
+	)
+
+	updates := &targetUpdates{}
+
+	// port is the port of the service, mapped to the 8080 of the pods
+	discovery, err := NewKubeDiscovery(client, KubeOpt{
+		Namespace: "prod",
+		Service:   "foo",
+		Port:      80,
+		Timeout:   5 * time.Second,
+	}, updates.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer discovery.Close()
+
+	discovery.Refresh()
+	go discovery.Run()
+
+	got := updates.all()
+	if len(got) != 1 || !sameState(kubeState(got[0]), map[string]bool{"10.0.0.1:8080": true}) {
+		t.Fatalf("updates = %v", got)
+	}
+
+	// a pod terminating is drained while another takes over
+	slices := client.DiscoveryV1().EndpointSlices("prod")
+
+	_, err = slices.Update(context.Background(), kubeSlice("foo-a", ports,
+		kubeEndpoint("10.0.0.1", kubeBool(false), kubeBool(true), kubeBool(true)),
+		kubeEndpoint("10.0.0.2", kubeBool(true), nil, nil),
+	), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		"10.0.0.1:8080": false,
+		"10.0.0.2:8080": true,
+	}
+
+	waitFor(t, func() bool {
+		got := updates.all()
+		return sameState(kubeState(got[len(got)-1]), want)
+	})
+
+	// slices of other services are ignored
+	other := kubeSlice("bar-a", ports, kubeEndpoint("10.0.1.1", nil, nil, nil))
+	other.Labels[discoveryv1.LabelServiceName] = "bar"
+
+	if _, err := slices.Create(context.Background(), other, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second slice of the service adds to the first
+	if _, err := slices.Create(context.Background(), kubeSlice("foo-b", ports, kubeEndpoint("10.0.0.3", nil, nil, nil)), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want["10.0.0.3:8080"] = true
+
+	waitFor(t, func() bool {
+		got := updates.all()
+		return sameState(kubeState(got[len(got)-1]), want)
+	})
+
+	// removing every endpoint keeps the previous backends
+	n := len(updates.all())
+
+	for _, name := range []string{"foo-a", "foo-b"} {
+		if err := slices.Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if got := updates.all(); len(got) != n {
+		t.Fatalf("updates after the slices were deleted = %v", got[n:])
+	}
+}
+
+func TestKubeDiscoveryPortName(t *testing.T) {
+	client := fake.NewClientset(
+		kubeSlice("foo-a", []discoveryv1.EndpointPort{kubePortOf("grpc", 8080), kubePortOf("metrics", 9090)},
+			kubeEndpoint("10.0.0.1", nil, nil, nil),
+		),
+	)
+
+	updates := &targetUpdates{}
+	discovery, err := NewKubeDiscovery(client, KubeOpt{
+		Namespace: "prod",
+		Service:   "foo",
+		PortName:  "metrics",
+	}, updates.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer discovery.Close()
+
+	// port names need no service lookup
+	discovery.Refresh()
+
+	got := updates.all()
+	if len(got) != 1 || !sameState(kubeState(got[0]), map[string]bool{"10.0.0.1:9090": true}) {
+		t.Fatalf("updates = %v", got)
+	}
+}
+
+func TestKubeDiscoveryMissingPort(t *testing.T) {
+	client := fake.NewClientset(
+		kubeSlice("foo-a", []discoveryv1.EndpointPort{kubePortOf("grpc", 8080)},
+			kubeEndpoint("10.0.0.1", nil, nil, nil),
+		),
+	)
+
+	updates := &targetUpdates{}
+	discovery, err := NewKubeDiscovery(client, KubeOpt{
+		Namespace: "prod",
+		Service:   "foo",
+		Port:      80,
+		Timeout:   50 * time.Millisecond,
+	}, updates.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer discovery.Close()
+
+	// a target port isn't a service port
+	if _, err := client.CoreV1().Services("prod").Create(context.Background(), kubeService(
+		corev1.ServicePort{Name: "grpc", Port: 8080, TargetPort: intstr.FromInt32(8080)},
+	), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	discovery.Refresh()
+	go discovery.Run()
+
+	if got := updates.all(); len(got) != 0 {
+		t.Fatalf("updates = %v, want none", got)
+	}
+
+	// Run looks the port up again
+	if _, err := client.CoreV1().Services("prod").Update(context.Background(), kubeService(
+		corev1.ServicePort{Name: "grpc", Port: 80, TargetPort: intstr.FromInt32(8080)},
+	), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		got := updates.all()
+		return len(got) == 1 && sameState(kubeState(got[0]), map[string]bool{"10.0.0.1:8080": true})
+	})
+}
+
+func TestNewKubeDiscoveryInvalid(t *testing.T) {
+	client := fake.NewClientset()
+
+	for _, opt := range []KubeOpt{
+		{},
+		{Service: "foo", Port: 80, PortName: "grpc"},
+		{Service: "foo", Port: 70000},
+	} {
+		if _, err := NewKubeDiscovery(client, opt, func([]Target) {}); err == nil {
+			t.Errorf("%+v accepted", opt)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package netutil
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type HeaderMatchOpt struct {
+	Exact   string
+	Prefix  string
+	Regex   string
+	Present bool
+	Absent  bool
+}
+
+// HeaderMatcher matches a request header, i.e. grpc metadata, against one
+// of an exact value, a prefix, a regular expression, or its mere presence
+// or absence. A header sent several times matches if any of its values do.
+type HeaderMatcher struct {
+	name string
+	opt  HeaderMatchOpt
+	re   *regexp.Regexp
+}
+
+// NewHeaderMatcher requires exactly one kind of match to be set in opt.
+// Regular expressions must match the whole value.
+func NewHeaderMatcher(name string, opt HeaderMatchOpt) (*HeaderMatcher, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("header name required")
+	}
+
+	kinds := 0
+	for _, set := range []bool{opt.Exact != "", opt.Prefix != "", opt.Regex != "", opt.Present, opt.Absent} {
+		if set {
+			kinds++
+		}
+	}
+
+	if kinds != 1 {
+		return nil, fmt.Errorf("header %s: exactly one of exact, prefix, regex, present and absent required", name)
+	}
+
+	matcher := &HeaderMatcher{
+		name: http.CanonicalHeaderKey(name),
+		opt:  opt,
+	}
+
+	if opt.Regex != "" {
+		re, err := regexp.Compile("^(?:" + opt.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %s", name, err)
+		}
+
+		matcher.re = re
+	}
+
+	return matcher, nil
+}
+
+func (this *HeaderMatcher) Match(req *http.Request) bool {
+	values, present := req.Header[this.name]
+
+	switch {
+	case this.opt.Present:
+		return present
+
+	case this.opt.Absent:
+		return !present
+	}
+
+	for _, value := range values {
+		switch {
+		case this.opt.Exact != "" && value == this.opt.Exact,
+			this.opt.Prefix != "" && strings.HasPrefix(value, this.opt.Prefix),
+			this.re != nil && this.re.MatchString(value):
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *HeaderMatcher) String() string {
+	switch {
+	case this.opt.Present:
+		return this.name + " present"
+
+	case this.opt.Absent:
+		return this.name + " absent"
+
+	case this.opt.Prefix != "":
+		return fmt.Sprintf("%s prefix %q", this.name, this.opt.Prefix)
+
+	case this.re != nil:
+		return fmt.Sprintf("%s regex %q", this.name, this.opt.Regex)
+	}
+
+	return fmt.Sprintf("%s = %q", this.name, this.opt.Exact)
+}
@@ -0,0 +1,159 @@
+package netutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultShadowHeader tags the requests sent to a shadow cluster.
+const DefaultShadowHeader = "X-Grpcproxy-Shadow"
+
+type MirrorOpt struct {
+	// Percent of the requests copied to the shadow cluster.
+	Percent float64
+
+	// MaxBufferSize is the number of request body bytes kept for the
+	// copy. Requests with larger bodies are not mirrored.
+	MaxBufferSize int
+
+	// Header is set to "true" on shadow requests.
+	Header string
+
+	// Timeout bounds every shadow request, MaxInFlight how many may be
+	// outstanding; requests beyond that are not mirrored.
+	Timeout     time.Duration
+	MaxInFlight int
+}
+
+func (this MirrorOpt) withDefaults() MirrorOpt {
+	if this.Percent > 100 {
+		this.Percent = 100
+	}
+
+	if this.MaxBufferSize <= 0 {
+		this.MaxBufferSize = 64 << 10
+	}
+
+	if this.Header == "" {
+		this.Header = DefaultShadowHeader
+	}
+
+	if this.Timeout <= 0 {
+		this.Timeout = 5 * time.Second
+	}
+
+	if this.MaxInFlight <= 0 {
+		this.MaxInFlight = 256
+	}
+
+	return this
+}
+
+// NewMirror copies requests to backends, the shadow cluster, as picked by
+// balancer. Shadow requests are sent once the primary request is done, and
+// their responses are discarded.
+func NewMirror(balancer Balancer, backends []*ReverseProxyBackend, opt MirrorOpt) *Mirror {
+	Attach(balancer, backends)
+
+	return &Mirror{
+		opt:      opt.withDefaults(),
+		balancer: balancer,
+		backends: backends,
+	}
+}
+
+type Mirror struct {
+	opt      MirrorOpt
+	balancer Balancer
+	backends []*ReverseProxyBackend
+
+	inflight atomic.Int64
+}
+
+// Tee samples req for mirroring. If it is picked, Tee returns a request
+// recording its body for the copy and a function sending the copy, to be
+// called after the primary request is done. Otherwise it returns req and
+// a nil function.
+func (this *Mirror) Tee(req *http.Request) (*http.Request, func()) {
+	if !sample(this.opt.Percent) {
+		return req, nil
+	}
+
+	body := newReplayBody(req.Body, this.opt.MaxBufferSize)
+
+	primary := req.Clone(req.Context())
+	primary.Body = body.reader()
+
+	return primary, func() {
+		this.shadow(req, body)
+	}
+}
+
+func (this *Mirror) shadow(req *http.Request, body *replayBody) {
+	data, ok := body.recorded()
+	if !ok {
+		log.Printf("[MIRROR][%s] %s skipped, request body not fully buffered", req.Method, req.URL)
+		return
+	}
+
+	if this.inflight.Add(1) > int64(this.opt.MaxInFlight) {
+		this.inflight.Add(-1)
+		log.Printf("[MIRROR][%s] %s skipped, %d shadow requests in flight", req.Method, req.URL, this.opt.MaxInFlight)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), this.opt.Timeout)
+
+	sreq := req.Clone(ctx)
+	sreq.Header.Set(this.opt.Header, "true")
+	sreq.ContentLength = int64(len(data))
+	sreq.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if len(data) == 0 {
+		sreq.Body = http.NoBody
+	}
+
+	go func() {
+		defer this.inflight.Add(-1)
+		defer cancel()
+
+		w := &discardWriter{
+			header: http.Header{},
+		}
+
+		this.balancer.Pick(sreq).ServeHTTP(w, sreq)
+	}()
+}
+
+// Close undoes what NewMirror registered with the shadow backends.
+func (this *Mirror) Close() {
+	Detach(this.balancer, this.backends)
+}
+
+func (this *Mirror) String() string {
+	return fmt.Sprintf("[MIRROR] %g%% to %v", this.opt.Percent, this.balancer)
+}
+
+// discardWriter swallows the response of a shadow request.
+type discardWriter struct {
+	header http.Header
+}
+
+func (this *discardWriter) Header() http.Header {
+	return this.header
+}
+
+func (this *discardWriter) WriteHeader(int) {
+}
+
+func (this *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (this *discardWriter) Flush() {
+}
@@ -0,0 +1,86 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Outcome describes how a single request proxied to a backend ended.
+// HeaderDuration is the time to response headers, Duration the time until
+// the response, trailers included, was complete.
+type Outcome struct {
+	StatusCode     int
+	GRPCCode       codes.Code
+	Err            error
+	HeaderDuration time.Duration
+	Duration       time.Duration
+}
+
+// Failed reports whether the outcome should count against the backend:
+// transport errors, http 5xx and grpc UNAVAILABLE / INTERNAL statuses.
+// Requests cancelled by the client are not the backend's fault.
+func (this Outcome) Failed() bool {
+	if this.Err != nil {
+		return !errors.Is(this.Err, context.Canceled)
+	}
+
+	if this.StatusCode >= http.StatusInternalServerError {
+		return true
+	}
+
+	switch this.GRPCCode {
+	case codes.Unavailable, codes.Internal:
+		return true
+	}
+
+	return false
+}
+
+// Observer is notified every time a backend finishes serving a request.
+type Observer interface {
+	Observe(backend *ReverseProxyBackend, outcome Outcome)
+}
+
+// Attach registers the balancer with its backends if it wants feedback,
+// i.e. if it also implements Observer.
+func Attach(balancer Balancer, backends []*ReverseProxyBackend) {
+	if o, ok := balancer.(Observer); ok {
+		for _, backend := range backends {
+			backend.AddObserver(o)
+		}
+	}
+}
+
+// Detach undoes Attach.
+func Detach(balancer Balancer, backends []*ReverseProxyBackend) {
+	if o, ok := balancer.(Observer); ok {
+		for _, backend := range backends {
+			backend.RemoveObserver(o)
+		}
+	}
+}
+
+// grpcCode extracts the grpc status from either the response headers
+// (trailers-only responses) or the trailers copied by the reverse proxy.
+func grpcCode(header http.Header) codes.Code {
+	value := header.Get("Grpc-Status")
+	if value == "" {
+		value = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+
+	if value == "" {
+		return codes.OK
+	}
+
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return codes.Unknown
+	}
+
+	return codes.Code(code)
+}
@@ -0,0 +1,245 @@
+package netutil
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	_ Observer = &OutlierDetector{}
+)
+
+type OutlierOpt struct {
+	// Interval between failure-rate evaluations. It is also the time
+	// needed for an ejection multiplier to decay by one step.
+	Interval time.Duration
+
+	// ConsecutiveFailures ejects a backend after that many failures
+	// in a row. 0 disables it.
+	ConsecutiveFailures int
+
+	// FailurePercent ejects a backend whose failure rate within one
+	// interval reaches the given percentage, provided it served at least
+	// RequestVolume requests. 0 disables it.
+	FailurePercent int
+	RequestVolume  int
+
+	// An ejected backend stays out for BaseEjectionTime * 2^(n-1), n being
+	// the number of recent ejections, capped at MaxEjectionTime.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+
+	// MaxEjectionPercent caps the share of backends ejected at once.
+	// At least one backend may always be ejected.
+	MaxEjectionPercent int
+}
+
+func (this OutlierOpt) withDefaults() OutlierOpt {
+	if this.Interval <= 0 {
+		this.Interval = 10 * time.Second
+	}
+
+	if this.RequestVolume <= 0 {
+		this.RequestVolume = 20
+	}
+
+	if this.BaseEjectionTime <= 0 {
+		this.BaseEjectionTime = 30 * time.Second
+	}
+
+	if this.MaxEjectionTime < this.BaseEjectionTime {
+		this.MaxEjectionTime = 10 * this.BaseEjectionTime
+	}
+
+	if this.MaxEjectionPercent <= 0 {
+		this.MaxEjectionPercent = 10
+	}
+
+	return this
+}
+
+type outlierStats struct {
+	requests    int
+	failures    int
+	consecutive int
+	ejections   uint
+	ejectedAt   time.Time
+}
+
+// NewOutlierDetector watches the outcome of every request served by the
+// given backends and temporarily ejects the misbehaving ones.
+func NewOutlierDetector(backends []*ReverseProxyBackend, opt OutlierOpt) *OutlierDetector {
+	d := &OutlierDetector{
+		backends: backends,
+		opt:      opt.withDefaults(),
+		stats:    make(map[*ReverseProxyBackend]*outlierStats, len(backends)),
+		closeCh:  make(chan struct{}),
+	}
+
+	for _, backend := range backends {
+		d.stats[backend] = &outlierStats{}
+		backend.AddObserver(d)
+	}
+
+	return d
+}
+
+type OutlierDetector struct {
+	backends []*ReverseProxyBackend
+	opt      OutlierOpt
+
+	mu    sync.Mutex
+	stats map[*ReverseProxyBackend]*outlierStats
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+func (this *OutlierDetector) Observe(backend *ReverseProxyBackend, outcome Outcome) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	st, ok := this.stats[backend]
+	if !ok {
+		return
+	}
+
+	st.requests += 1
+
+	if !outcome.Failed() {
+		st.consecutive = 0
+		return
+	}
+
+	st.failures += 1
+	st.consecutive += 1
+
+	if n := this.opt.ConsecutiveFailures; n > 0 && st.consecutive >= n {
+		reason := fmt.Sprintf("%d consecutive failures", st.consecutive)
+		if outcome.Err != nil {
+			reason = fmt.Sprintf("%s, last error: %s", reason, outcome.Err)
+		}
+
+		this.eject(backend, st, reason)
+	}
+}
+
+// Run blocks and evaluates the backends every interval until Close is called.
+func (this *OutlierDetector) Run() {
+	ticker := time.NewTicker(this.opt.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.closeCh:
+			return
+
+		case <-ticker.C:
+			this.evaluate()
+		}
+	}
+}
+
+// SetBackends replaces the watched backends, keeping the stats of those
+// watched already.
+func (this *OutlierDetector) SetBackends(backends []*ReverseProxyBackend) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	keep := make(map[*ReverseProxyBackend]bool, len(backends))
+	for _, backend := range backends {
+		keep[backend] = true
+
+		if _, ok := this.stats[backend]; !ok {
+			this.stats[backend] = &outlierStats{}
+			backend.AddObserver(this)
+		}
+	}
+
+	for _, backend := range this.backends {
+		if !keep[backend] {
+			delete(this.stats, backend)
+			backend.RemoveObserver(this)
+		}
+	}
+
+	this.backends = backends
+}
+
+func (this *OutlierDetector) Close() {
+	this.closeOnce.Do(func() {
+		this.mu.Lock()
+		backends := this.backends
+		this.mu.Unlock()
+
+		for _, backend := range backends {
+			backend.RemoveObserver(this)
+		}
+
+		close(this.closeCh)
+	})
+}
+
+func (this *OutlierDetector) evaluate() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+
+	for _, backend := range this.backends {
+		st := this.stats[backend]
+		status := backend.HealthStatus()
+
+		if status.Ejected {
+			if now.Before(status.EjectedUntil) {
+				st.requests, st.failures = 0, 0
+				continue
+			}
+
+			backend.clearEjected()
+		}
+
+		if pct := this.opt.FailurePercent; pct > 0 && st.requests >= this.opt.RequestVolume && st.failures*100 >= pct*st.requests {
+			this.eject(backend, st, fmt.Sprintf("%d of %d requests failed within %s", st.failures, st.requests, this.opt.Interval))
+		} else if st.ejections > 0 && now.Sub(st.ejectedAt) >= this.opt.Interval {
+			st.ejections -= 1
+		}
+
+		st.requests, st.failures = 0, 0
+	}
+}
+
+func (this *OutlierDetector) eject(backend *ReverseProxyBackend, st *outlierStats, reason string) {
+	now := time.Now()
+
+	ejected := 0
+	for _, one := range this.backends {
+		if status := one.HealthStatus(); status.Ejected && now.Before(status.EjectedUntil) {
+			if one == backend {
+				return
+			}
+
+			ejected += 1
+		}
+	}
+
+	if max := len(this.backends) * this.opt.MaxEjectionPercent / 100; ejected > 0 && ejected >= max {
+		return
+	}
+
+	st.ejections += 1
+	st.ejectedAt = now
+	st.consecutive = 0
+
+	d := this.opt.BaseEjectionTime
+	for i := uint(1); i < st.ejections && d < this.opt.MaxEjectionTime; i++ {
+		d *= 2
+	}
+
+	if d > this.opt.MaxEjectionTime {
+		d = this.opt.MaxEjectionTime
+	}
+
+	backend.setEjected(now.Add(d), reason)
+}
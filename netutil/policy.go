@@ -2,7 +2,6 @@ package netutil
 
 import (
 	"fmt"
-	"hash/fnv"
 	"math/rand"
 	"net/http"
 	"sync"
@@ -11,36 +10,50 @@ import (
 var (
 	_ Balancer = &reverseRandom{}
 	_ Balancer = &reverseRoundRobin{}
+	_ Balancer = &reverseHash{}
+	_ Balancer = &reverseLeast{}
+	_ Balancer = &reverseP2C{}
 
 	errBackendsRequired = fmt.Errorf("reverse proxy backends required, got 0")
 )
 
-func Random(backends []*ReverseProxyBackend) (*reverseRandom, error) {
-	if len(backends) == 0 {
-		return nil, errBackendsRequired
+// available returns the backends which may currently be picked.
+// If none of them is available, all backends are returned so that
+// traffic keeps flowing instead of being dropped on the floor.
+func available(backends []*ReverseProxyBackend) []*ReverseProxyBackend {
+	n := 0
+	for _, backend := range backends {
+		if backend.Available() {
+			n += 1
+		}
 	}
 
-	weightN := 0
-	weights := make([]int, len(backends))
+	if n == len(backends) || n == 0 {
+		return backends
+	}
 
-	for i, backend := range backends {
-		weightN += backend.Weight
-		weights[i] = weightN
+	res := make([]*ReverseProxyBackend, 0, n)
+	for _, backend := range backends {
+		if backend.Available() {
+			res = append(res, backend)
+		}
+	}
+
+	return res
+}
+
+func Random(backends []*ReverseProxyBackend) (*reverseRandom, error) {
+	if len(backends) == 0 {
+		return nil, errBackendsRequired
 	}
 
 	return &reverseRandom{
 		backends: backends,
-
-		weightN: weightN,
-		weights: weights,
 	}, nil
 }
 
 type reverseRandom struct {
 	backends []*ReverseProxyBackend
-
-	weightN int
-	weights []int
 }
 
 func (this *reverseRandom) Pick(req *http.Request) http.Handler {
@@ -48,20 +61,47 @@ func (this *reverseRandom) Pick(req *http.Request) http.Handler {
 		return this.backends[0]
 	}
 
-	rnd := rand.Intn(this.weightN)
-	for idx, n := range this.weights {
-		if rnd < n {
-			return this.backends[idx]
+	return pickWeighted(available(this.backends))
+}
+
+func pickWeighted(backends []*ReverseProxyBackend) *ReverseProxyBackend {
+	weights := make([]int, len(backends))
+	weightN := 0
+	for i, backend := range backends {
+		weights[i] = backend.effectiveWeight()
+		weightN += weights[i]
+	}
+
+	rnd := rand.Intn(weightN)
+	for i, backend := range backends {
+		if rnd < weights[i] {
+			return backend
 		}
+
+		rnd -= weights[i]
 	}
 
-	return this.backends[rand.Intn(len(this.backends))]
+	return backends[len(backends)-1]
 }
 
 func (this *reverseRandom) String() string {
-	return fmt.Sprintf("[RANDOM] %d backends, weighs %v", len(this.backends), this.weights)
+	return fmt.Sprintf("[RANDOM] %d backends, weights %v", len(this.backends), weightsOf(this.backends))
 }
 
+func weightsOf(backends []*ReverseProxyBackend) []int {
+	weights := make([]int, len(backends))
+	for i, backend := range backends {
+		weights[i] = backend.Weight()
+	}
+
+	return weights
+}
+
+// RoundRobin is nginx's smooth weighted round robin: every pick, each
+// available backend's current weight grows by its weight, the largest one
+// is picked and then lowered by the sum of weights. Picks of heavier
+// backends are interleaved with the others rather than sent in bursts,
+// and weight changes take effect on the next pick without a reset.
 func RoundRobin(backends []*ReverseProxyBackend) (*reverseRoundRobin, error) {
 	if len(backends) == 0 {
 		return nil, errBackendsRequired
@@ -69,14 +109,15 @@ func RoundRobin(backends []*ReverseProxyBackend) (*reverseRoundRobin, error) {
 
 	return &reverseRoundRobin{
 		backends: backends,
+		current:  make([]int, len(backends)),
 	}, nil
 }
 
 type reverseRoundRobin struct {
 	backends []*ReverseProxyBackend
 
-	mutex sync.Mutex
-	idx   int
+	mutex   sync.Mutex
+	current []int
 }
 
 func (this *reverseRoundRobin) Pick(req *http.Request) http.Handler {
@@ -87,28 +128,54 @@ func (this *reverseRoundRobin) Pick(req *http.Request) http.Handler {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
 
-	h := this.backends[this.idx]
+	if idx := this.pick(true); idx >= 0 {
+		return this.backends[idx]
+	}
+
+	return this.backends[this.pick(false)]
+}
+
+func (this *reverseRoundRobin) pick(onlyAvailable bool) int {
+	best, total := -1, 0
+	for i, backend := range this.backends {
+		if onlyAvailable && !backend.Available() {
+			continue
+		}
+
+		w := backend.effectiveWeight()
+		this.current[i] += w
+		total += w
+
+		if best < 0 || this.current[i] > this.current[best] {
+			best = i
+		}
+	}
+
+	if best >= 0 {
+		this.current[best] -= total
+	}
 
-	this.idx = (this.idx + 1) % len(this.backends)
-	return h
+	return best
 }
 
 func (this *reverseRoundRobin) String() string {
-	return fmt.Sprintf("[ROUND ROBIN] %d backends", len(this.backends))
+	return fmt.Sprintf("[ROUND ROBIN] %d backends, weights %v", len(this.backends), weightsOf(this.backends))
 }
 
-func Hash(backends []*ReverseProxyBackend) (*reverseHash, error) {
+func Hash(backends []*ReverseProxyBackend, key HashKey) (*reverseHash, error) {
 	if len(backends) == 0 {
 		return nil, errBackendsRequired
 	}
 
 	return &reverseHash{
 		backends: backends,
+		key:      key,
 	}, nil
 }
 
 type reverseHash struct {
 	backends []*ReverseProxyBackend
+	key      HashKey
 }
 
 func (this *reverseHash) Pick(req *http.Request) http.Handler {
@@ -116,19 +183,14 @@ func (this *reverseHash) Pick(req *http.Request) http.Handler {
 		return this.backends[0]
 	}
 
-	idx := hash(req.RemoteAddr) % len(this.backends)
+	backends := available(this.backends)
+	idx := hash64(this.key(req)) % uint64(len(backends))
 
-	return this.backends[idx]
+	return backends[idx]
 }
 
 func (this *reverseHash) String() string {
-	return fmt.Sprintf("[HASH] %d backends with fnv.New64", len(this.backends))
-}
-
-func hash(s string) int {
-	h := fnv.New64()
-	h.Write([]byte(s))
-	return int(h.Sum64())
+	return fmt.Sprintf("[HASH] %d backends with fnv.New64a", len(this.backends))
 }
 
 func Least(backends []*ReverseProxyBackend) (*reverseLeast, error) {
@@ -150,24 +212,26 @@ func (this *reverseLeast) Pick(req *http.Request) http.Handler {
 		return this.backends[0]
 	}
 
-	size := len(this.backends)
-	least := this.backends[0].Count
+	backends := available(this.backends)
+	size := len(backends)
+	least := leastCost(backends[0])
 	choice := []*ReverseProxyBackend{
-		this.backends[0],
+		backends[0],
 	}
 
 	for i := 1; i < size; i++ {
-		b := this.backends[i]
-		if b.Count > least {
+		b := backends[i]
+		n := leastCost(b)
+		if n > least {
 			continue
 		}
 
-		if b.Count == least {
+		if n == least {
 			choice = append(choice, b)
 		}
 
-		if b.Count < least {
-			least = b.Count
+		if n < least {
+			least = n
 			choice = []*ReverseProxyBackend{
 				b,
 			}
@@ -181,6 +245,70 @@ func (this *reverseLeast) Pick(req *http.Request) http.Handler {
 	return choice[rand.Intn(len(choice))]
 }
 
+// leastCost counts the request being picked for along with those in
+// flight, inflated while the backend is ramping up.
+func leastCost(backend *ReverseProxyBackend) float64 {
+	return float64(backend.InFlight()+1) / backend.warmup()
+}
+
 func (this *reverseLeast) String() string {
 	return fmt.Sprintf("[LEAST] %d backends", len(this.backends))
 }
+
+// P2C picks two random backends and sends the request to the one with
+// fewer requests in flight, so it never has to scan the whole backend set.
+func P2C(backends []*ReverseProxyBackend) (*reverseP2C, error) {
+	if len(backends) == 0 {
+		return nil, errBackendsRequired
+	}
+
+	return &reverseP2C{
+		backends: backends,
+	}, nil
+}
+
+type reverseP2C struct {
+	backends []*ReverseProxyBackend
+}
+
+func (this *reverseP2C) Pick(req *http.Request) http.Handler {
+	a, b := twoRandom(this.backends)
+	if b.InFlight() < a.InFlight() {
+		return b
+	}
+
+	return a
+}
+
+// twoRandom returns two distinct random backends, replacing unavailable ones.
+func twoRandom(backends []*ReverseProxyBackend) (*ReverseProxyBackend, *ReverseProxyBackend) {
+	size := len(backends)
+	if size == 1 {
+		return backends[0], backends[0]
+	}
+
+	i, j := rand.Intn(size), rand.Intn(size-1)
+	if j >= i {
+		j += 1
+	}
+
+	a, b := backends[i], backends[j]
+	if a.Available() && b.Available() {
+		return a, b
+	}
+
+	if backends = available(backends); len(backends) == 1 {
+		return backends[0], backends[0]
+	}
+
+	i, j = rand.Intn(len(backends)), rand.Intn(len(backends)-1)
+	if j >= i {
+		j += 1
+	}
+
+	return backends[i], backends[j]
+}
+
+func (this *reverseP2C) String() string {
+	return fmt.Sprintf("[P2C] %d backends", len(this.backends))
+}
@@ -0,0 +1,146 @@
+package netutil
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+var (
+	_ Balancer = &reversePriority{}
+	_ Observer = &reversePriority{}
+)
+
+// TierHeader is the response header naming the priority group of the
+// backend which served the request.
+const TierHeader = "X-Grpcproxy-Tier"
+
+// DefaultOverprovisioning is the overprovisioning factor, in percent, used
+// when none is configured.
+const DefaultOverprovisioning = 140
+
+// PriorityGroup is one failover tier: a set of backends with their own
+// balancer. Lower indexes have higher priority.
+type PriorityGroup struct {
+	Name     string
+	Backends []*ReverseProxyBackend
+	Balancer Balancer
+}
+
+// Priority spreads requests over failover tiers. A tier takes as much
+// traffic as its healthy fraction times overprovisioning (in percent)
+// allows, capped at 100%, and what it can't take spills to the next tier.
+// With the default of 140, the primary tier keeps all traffic until less
+// than ~72% of its backends are available.
+func Priority(groups []PriorityGroup, overprovisioning int) (*reversePriority, error) {
+	if len(groups) == 0 {
+		return nil, errBackendsRequired
+	}
+
+	if overprovisioning <= 0 {
+		overprovisioning = DefaultOverprovisioning
+	}
+
+	groupOf := make(map[*ReverseProxyBackend]int)
+	for i, group := range groups {
+		if len(group.Backends) == 0 || group.Balancer == nil {
+			return nil, fmt.Errorf("priority group %q: %s", group.Name, errBackendsRequired)
+		}
+
+		for _, backend := range group.Backends {
+			backend.setGroup(group.Name)
+			groupOf[backend] = i
+		}
+	}
+
+	return &reversePriority{
+		groups:           groups,
+		groupOf:          groupOf,
+		overprovisioning: overprovisioning,
+	}, nil
+}
+
+type reversePriority struct {
+	groups           []PriorityGroup
+	groupOf          map[*ReverseProxyBackend]int
+	overprovisioning int
+}
+
+func (this *reversePriority) Pick(req *http.Request) http.Handler {
+	loads := this.loads()
+
+	total := 0
+	for _, load := range loads {
+		total += load
+	}
+
+	// nothing is available anywhere, let the primary tier sort it out
+	if total == 0 {
+		return this.groups[0].Balancer.Pick(req)
+	}
+
+	rnd := rand.Intn(total)
+	for i, load := range loads {
+		if rnd < load {
+			return this.groups[i].Balancer.Pick(req)
+		}
+
+		rnd -= load
+	}
+
+	return this.groups[len(this.groups)-1].Balancer.Pick(req)
+}
+
+// loads returns the share of traffic, in percent, each tier receives.
+// They add up to 100 unless every tier is degraded, in which case Pick
+// normalizes over what is left.
+func (this *reversePriority) loads() []int {
+	loads := make([]int, len(this.groups))
+
+	left := 100
+	for i, group := range this.groups {
+		n := 0
+		for _, backend := range group.Backends {
+			if backend.Available() {
+				n++
+			}
+		}
+
+		health := n * this.overprovisioning / len(group.Backends)
+		if health > 100 {
+			health = 100
+		}
+
+		if health > left {
+			health = left
+		}
+
+		loads[i] = health
+		left -= health
+	}
+
+	return loads
+}
+
+// Observe forwards outcomes to the balancer of the backend's tier, for
+// policies which learn from them.
+func (this *reversePriority) Observe(backend *ReverseProxyBackend, outcome Outcome) {
+	i, ok := this.groupOf[backend]
+	if !ok {
+		return
+	}
+
+	if observer, ok := this.groups[i].Balancer.(Observer); ok {
+		observer.Observe(backend, outcome)
+	}
+}
+
+func (this *reversePriority) String() string {
+	tiers := make([]string, len(this.groups))
+	for i, group := range this.groups {
+		tiers[i] = fmt.Sprintf("%s: %v", group.Name, group.Balancer)
+	}
+
+	return fmt.Sprintf("[PRIORITY] overprovisioning %d%%, tiers [%s]", this.overprovisioning, strings.Join(tiers, "; "))
+}
@@ -0,0 +1,197 @@
+package netutil
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBalancer is the policy used when a proxy doesn't name one.
+const DefaultBalancer = "round"
+
+// BalancerFactory builds the balancer of a named policy.
+type BalancerFactory struct {
+	// Options returns a fresh value for the policy's options block to be
+	// decoded into, usually a pointer to a struct with hcl tags. It may be
+	// nil for policies which take no options.
+	Options func() interface{}
+
+	// New builds the balancer over backends. opts is the value returned by
+	// Options after decoding, or nil.
+	New func(backends []*ReverseProxyBackend, opts interface{}) (Balancer, error)
+}
+
+var (
+	balancersMu sync.RWMutex
+	balancers   = map[string]BalancerFactory{}
+)
+
+// RegisterBalancer makes a balancer policy available by name. It is meant
+// to be called from init functions, and panics if the name is empty or
+// already registered.
+func RegisterBalancer(name string, factory BalancerFactory) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+
+	if name == "" {
+		panic("netutil: RegisterBalancer with empty name")
+	}
+
+	if factory.New == nil {
+		panic("netutil: RegisterBalancer factory for " + name + " is nil")
+	}
+
+	if _, dup := balancers[name]; dup {
+		panic("netutil: RegisterBalancer called twice for " + name)
+	}
+
+	balancers[name] = factory
+}
+
+// LookupBalancer returns the factory registered under name.
+func LookupBalancer(name string) (BalancerFactory, bool) {
+	balancersMu.RLock()
+	defer balancersMu.RUnlock()
+
+	factory, ok := balancers[name]
+	return factory, ok
+}
+
+// Balancers returns the sorted names of the registered policies.
+func Balancers() []string {
+	balancersMu.RLock()
+	defer balancersMu.RUnlock()
+
+	names := make([]string, 0, len(balancers))
+	for name := range balancers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// HashOptions is the options block of the hash, ring_hash and maglev
+// policies.
+//
+//	balancer {
+//	    hash_key = "header:x-session-id"
+//	}
+type HashOptions struct {
+	HashKey string `hcl:"hash_key,omitempty" json:"hash_key,omitempty"`
+}
+
+// PeakEWMAOptions is the options block of the ewma policy.
+//
+//	balancer {
+//	    decay = "10s"
+//	    failure_penalty = "1s"
+//	    default_latency = "100ms"
+//	}
+type PeakEWMAOptions struct {
+	Decay          string `hcl:"decay,omitempty" json:"decay,omitempty"`
+	FailurePenalty string `hcl:"failure_penalty,omitempty" json:"failure_penalty,omitempty"`
+	DefaultLatency string `hcl:"default_latency,omitempty" json:"default_latency,omitempty"`
+}
+
+func init() {
+	RegisterBalancer("round", BalancerFactory{
+		New: func(backends []*ReverseProxyBackend, _ interface{}) (Balancer, error) {
+			return RoundRobin(backends)
+		},
+	})
+
+	RegisterBalancer("random", BalancerFactory{
+		New: func(backends []*ReverseProxyBackend, _ interface{}) (Balancer, error) {
+			return Random(backends)
+		},
+	})
+
+	RegisterBalancer("least", BalancerFactory{
+		New: func(backends []*ReverseProxyBackend, _ interface{}) (Balancer, error) {
+			return Least(backends)
+		},
+	})
+
+	RegisterBalancer("p2c", BalancerFactory{
+		New: func(backends []*ReverseProxyBackend, _ interface{}) (Balancer, error) {
+			return P2C(backends)
+		},
+	})
+
+	RegisterBalancer("hash", hashFactory(func(backends []*ReverseProxyBackend, key HashKey) (Balancer, error) {
+		return Hash(backends, key)
+	}))
+
+	RegisterBalancer("ring_hash", hashFactory(func(backends []*ReverseProxyBackend, key HashKey) (Balancer, error) {
+		return RingHash(backends, key)
+	}))
+
+	RegisterBalancer("maglev", hashFactory(func(backends []*ReverseProxyBackend, key HashKey) (Balancer, error) {
+		return Maglev(backends, key)
+	}))
+
+	RegisterBalancer("ewma", BalancerFactory{
+		Options: func() interface{} {
+			return &PeakEWMAOptions{}
+		},
+		New: func(backends []*ReverseProxyBackend, opts interface{}) (Balancer, error) {
+			o := opts.(*PeakEWMAOptions)
+
+			decay, err := parseOptDuration(o.Decay)
+			if err != nil {
+				return nil, fmt.Errorf("invalid decay: %s", err)
+			}
+
+			penalty, err := parseOptDuration(o.FailurePenalty)
+			if err != nil {
+				return nil, fmt.Errorf("invalid failure_penalty: %s", err)
+			}
+
+			latency, err := parseOptDuration(o.DefaultLatency)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default_latency: %s", err)
+			}
+
+			return PeakEWMA(backends, PeakEWMAOpt{
+				Decay:          decay,
+				FailurePenalty: penalty,
+				DefaultLatency: latency,
+			})
+		},
+	})
+}
+
+func hashFactory(build func([]*ReverseProxyBackend, HashKey) (Balancer, error)) BalancerFactory {
+	return BalancerFactory{
+		Options: func() interface{} {
+			return &HashOptions{}
+		},
+		New: func(backends []*ReverseProxyBackend, opts interface{}) (Balancer, error) {
+			key, err := ParseHashKey(opts.(*HashOptions).HashKey)
+			if err != nil {
+				return nil, err
+			}
+
+			return build(backends, key)
+		},
+	}
+}
+
+func parseOptDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if d < 0 {
+		return 0, fmt.Errorf("%q must not be negative", s)
+	}
+
+	return d, nil
+}
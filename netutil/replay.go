@@ -0,0 +1,154 @@
+package netutil
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	errAttemptClosed  = errors.New("request attempt already finished")
+	errReplayOverflow = errors.New("request body outgrew the replay buffer")
+)
+
+// newReplayBody records up to limit bytes of src so that the request body
+// can be sent again to another backend.
+func newReplayBody(src io.ReadCloser, limit int) *replayBody {
+	return &replayBody{
+		src:   src,
+		limit: limit,
+	}
+}
+
+type replayBody struct {
+	src   io.ReadCloser
+	limit int
+
+	// readMu serializes reads from src, mu guards the recorded state.
+	readMu sync.Mutex
+
+	mu       sync.Mutex
+	buf      []byte
+	overflow bool
+	err      error
+
+	// owner is the offset of the reader which overflowed the buffer, the
+	// only one that may read the rest of src.
+	owner *int
+}
+
+// replayable reports whether everything read so far is still recorded.
+func (this *replayBody) replayable() bool {
+	if this.src == nil {
+		return true
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return !this.overflow
+}
+
+// recorded returns the whole body, provided it has been read to the end
+// without overflowing.
+func (this *replayBody) recorded() ([]byte, bool) {
+	if this.src == nil || this.src == http.NoBody {
+		return nil, true
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.buf, this.err == io.EOF && !this.overflow
+}
+
+// reader returns a body for a new attempt, starting from the first byte.
+func (this *replayBody) reader() io.ReadCloser {
+	if this.src == nil || this.src == http.NoBody {
+		return http.NoBody
+	}
+
+	return &replayReader{
+		body: this,
+	}
+}
+
+func (this *replayBody) buffered(p []byte, off *int) (int, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if *off < len(this.buf) {
+		n := copy(p, this.buf[*off:])
+		*off += n
+		return n, true
+	}
+
+	return 0, false
+}
+
+func (this *replayBody) read(p []byte, off *int) (int, error) {
+	if n, ok := this.buffered(p, off); ok {
+		return n, nil
+	}
+
+	this.readMu.Lock()
+	defer this.readMu.Unlock()
+
+	// another attempt may have read ahead while we were waiting
+	if n, ok := this.buffered(p, off); ok {
+		return n, nil
+	}
+
+	this.mu.Lock()
+	err := this.err
+	if this.overflow && this.owner != off {
+		err = errReplayOverflow
+	}
+	this.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := this.src.Read(p)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if !this.overflow {
+		this.buf = append(this.buf, p[:n]...)
+		*off += n
+		this.overflow = len(this.buf) > this.limit
+
+		if this.overflow {
+			this.owner = off
+		}
+	}
+
+	if err != nil {
+		this.err = err
+	}
+
+	return n, err
+}
+
+type replayReader struct {
+	body   *replayBody
+	off    int
+	closed int32
+}
+
+func (this *replayReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return 0, errAttemptClosed
+	}
+
+	return this.body.read(p, &this.off)
+}
+
+func (this *replayReader) Close() error {
+	atomic.StoreInt32(&this.closed, 1)
+	return nil
+}
@@ -0,0 +1,63 @@
+package netutil
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReplayBodyOverflowOwner(t *testing.T) {
+	src := bytes.Repeat([]byte("0123456789"), 10)
+	body := newReplayBody(io.NopCloser(bytes.NewReader(src)), 10)
+
+	leader := body.reader()
+	laggard := body.reader()
+
+	// the leader reads past the buffer, so it owns the rest of the body
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(leader, head); err != nil {
+		t.Fatalf("leader read: %s", err)
+	}
+
+	if body.replayable() {
+		t.Fatalf("body still replayable after overflow")
+	}
+
+	got, err := io.ReadAll(laggard)
+	if err != errReplayOverflow {
+		t.Fatalf("laggard error = %v, want %v", err, errReplayOverflow)
+	}
+
+	if !bytes.Equal(got, src[:16]) {
+		t.Fatalf("laggard read %q, want the buffered %q", got, src[:16])
+	}
+
+	rest, err := io.ReadAll(leader)
+	if err != nil {
+		t.Fatalf("leader read: %s", err)
+	}
+
+	if full := append(head, rest...); !bytes.Equal(full, src) {
+		t.Fatalf("leader read %q, want %q", full, src)
+	}
+}
+
+func TestReplayBodyReplay(t *testing.T) {
+	src := []byte("hello world")
+	body := newReplayBody(io.NopCloser(bytes.NewReader(src)), 64)
+
+	for i := 0; i < 3; i++ {
+		got, err := io.ReadAll(body.reader())
+		if err != nil {
+			t.Fatalf("attempt %d: %s", i, err)
+		}
+
+		if !bytes.Equal(got, src) {
+			t.Fatalf("attempt %d read %q, want %q", i, got, src)
+		}
+	}
+
+	if data, ok := body.recorded(); !ok || !bytes.Equal(data, src) {
+		t.Fatalf("recorded %q, %v", data, ok)
+	}
+}
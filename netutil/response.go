@@ -0,0 +1,48 @@
+package netutil
+
+import (
+	"net/http"
+	"time"
+)
+
+var (
+	_ http.ResponseWriter = &responseWriter{}
+	_ http.Flusher        = &responseWriter{}
+)
+
+// responseWriter records what the reverse proxy wrote for a request.
+type responseWriter struct {
+	http.ResponseWriter
+
+	status   int
+	err      error
+	headerAt time.Time
+}
+
+func (this *responseWriter) WriteHeader(code int) {
+	if this.status == 0 {
+		this.status = code
+		this.headerAt = time.Now()
+	}
+
+	this.ResponseWriter.WriteHeader(code)
+}
+
+func (this *responseWriter) Write(b []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+		this.headerAt = time.Now()
+	}
+
+	return this.ResponseWriter.Write(b)
+}
+
+func (this *responseWriter) Flush() {
+	if f, ok := this.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (this *responseWriter) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
@@ -0,0 +1,188 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+var errPerTryTimeout = errors.New("per-try timeout exceeded")
+
+// ParseCode parses a grpc status code name such as "unavailable" or "RESOURCE_EXHAUSTED".
+func ParseCode(name string) (codes.Code, error) {
+	var code codes.Code
+	if err := code.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(strings.TrimSpace(name))))); err != nil {
+		return code, fmt.Errorf("unknown grpc status code %q", name)
+	}
+
+	return code, nil
+}
+
+type RetryOpt struct {
+	// MaxAttempts includes the first attempt.
+	MaxAttempts int
+
+	// RetryOn lists the grpc status codes worth another attempt.
+	// Responses without grpc status are retried on http 502, 503 and 504.
+	RetryOn []codes.Code
+
+	// Attempt n waits a random duration up to BackoffBase * 2^(n-1),
+	// capped at BackoffMax.
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+
+	// PerTryTimeout bounds how long an attempt may wait for response
+	// headers. 0 means no limit besides the request's own deadline.
+	PerTryTimeout time.Duration
+
+	// MaxBufferSize is the number of request body bytes kept for replay.
+	// Requests with larger bodies are not retried.
+	MaxBufferSize int
+}
+
+func (this RetryOpt) withDefaults() RetryOpt {
+	if this.MaxAttempts <= 0 {
+		this.MaxAttempts = 3
+	}
+
+	if len(this.RetryOn) == 0 {
+		this.RetryOn = []codes.Code{codes.Unavailable}
+	}
+
+	if this.BackoffBase <= 0 {
+		this.BackoffBase = 25 * time.Millisecond
+	}
+
+	if this.BackoffMax < this.BackoffBase {
+		this.BackoffMax = 10 * this.BackoffBase
+	}
+
+	if this.MaxBufferSize <= 0 {
+		this.MaxBufferSize = 64 << 10
+	}
+
+	return this
+}
+
+func NewRetry(opt RetryOpt) *Retry {
+	return &Retry{
+		opt: opt.withDefaults(),
+	}
+}
+
+// Retry sends a request to other backends picked by a balancer when an
+// attempt fails before any response header reached the client.
+type Retry struct {
+	opt RetryOpt
+}
+
+func (this *Retry) Serve(balancer Balancer, rw http.ResponseWriter, req *http.Request) {
+	body := newReplayBody(req.Body, this.opt.MaxBufferSize)
+	tried := make(map[http.Handler]bool, this.opt.MaxAttempts)
+
+	for attempt := 1; ; attempt++ {
+		h := pickUntried(balancer, req, tried)
+		tried[h] = true
+
+		last := attempt >= this.opt.MaxAttempts
+		w := newAttemptWriter(rw, func(status int, header http.Header) bool {
+			return !last && body.replayable() && this.retryable(status, header)
+		})
+
+		this.serveAttempt(h, w, req, body)
+
+		if !w.Discarded() {
+			return
+		}
+
+		backoff := this.backoff(attempt)
+		log.Printf("[RETRY][%s] %s attempt %d/%d failed, retrying in %s", req.Method, req.URL, attempt, this.opt.MaxAttempts, backoff)
+
+		select {
+		case <-req.Context().Done():
+			WriteContextError(rw, req, req.Context().Err())
+			return
+
+		case <-time.After(backoff):
+
+		}
+	}
+}
+
+func (this *Retry) serveAttempt(h http.Handler, w *attemptWriter, req *http.Request, body *replayBody) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	defer cancel(nil)
+
+	if d := this.opt.PerTryTimeout; d > 0 {
+		timer := time.AfterFunc(d, func() {
+			w.cancelUncommitted(func() {
+				cancel(errPerTryTimeout)
+			})
+		})
+
+		defer timer.Stop()
+	}
+
+	r := body.reader()
+	defer r.Close()
+
+	areq := req.WithContext(ctx)
+	areq.Body = r
+
+	h.ServeHTTP(w, areq)
+}
+
+func (this *Retry) retryable(status int, header http.Header) bool {
+	if header.Get("Grpc-Status") == "" {
+		switch status {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+
+		return false
+	}
+
+	code := grpcCode(header)
+	for _, one := range this.opt.RetryOn {
+		if code == one {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *Retry) backoff(attempt int) time.Duration {
+	d := this.opt.BackoffBase
+	for i := 1; i < attempt && d < this.opt.BackoffMax; i++ {
+		d *= 2
+	}
+
+	if d > this.opt.BackoffMax {
+		d = this.opt.BackoffMax
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// pickUntried asks the balancer a few times for a handler which has not
+// been tried yet, and settles for the last pick otherwise.
+func pickUntried(balancer Balancer, req *http.Request, tried map[http.Handler]bool) http.Handler {
+	var h http.Handler
+	for i := 0; i < 8; i++ {
+		h = balancer.Pick(req)
+		if !tried[h] {
+			break
+		}
+	}
+
+	return h
+}
@@ -1,11 +1,18 @@
 package netutil
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
 )
 
 var (
@@ -15,28 +22,331 @@ var (
 func NewReverseProxyBackend(rawBack string, target *url.URL, weight int, transport http.RoundTripper) *ReverseProxyBackend {
 	proxy := httputil.NewSingleHostReverseProxy(target)
 	proxy.Transport = transport
-	return &ReverseProxyBackend{
-		Weight:  weight,
-		rawBack: rawBack,
-		proxy:   proxy,
+	proxy.ErrorHandler = proxyErrorHandler
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+
+		// forward the remaining budget rather than the caller's original timeout
+		if deadline, ok := req.Context().Deadline(); ok && IsGRPCRequest(req) {
+			req.Header.Set(GRPCTimeoutHeader, EncodeGRPCTimeout(time.Until(deadline)))
+		}
 	}
+
+	backend := &ReverseProxyBackend{
+		rawBack:   rawBack,
+		target:    target,
+		transport: transport,
+		proxy:     proxy,
+
+		health: HealthStatus{
+			Healthy: true,
+			Since:   time.Now(),
+		},
+		warmSince: time.Now(),
+	}
+
+	backend.SetWeight(weight)
+	return backend
 }
 
 type ReverseProxyBackend struct {
-	Weight int
+	weight   atomic.Int64
+	requests atomic.Int64
+	inflight atomic.Int64
+
+	rawBack   string
+	group     string
+	target    *url.URL
+	transport http.RoundTripper
+	proxy     *httputil.ReverseProxy
+
+	healthMu  sync.RWMutex
+	health    HealthStatus
+	warmSince time.Time
+	slowStart SlowStartOpt
+	retired   bool
+
+	observerMu sync.RWMutex
+	observers  []Observer
+
+	breaker *Breaker
+}
+
+// HealthStatus is a snapshot of a backend's health as seen by its checker
+// and by passive outlier detection.
+type HealthStatus struct {
+	Healthy bool
+	Reason  string
+	Since   time.Time
+
+	Ejected      bool
+	EjectedUntil time.Time
+	EjectReason  string
 
-	Count   int64
-	rawBack string
-	target  *url.URL
-	proxy   *httputil.ReverseProxy
+	Breaker BreakerState
 }
 
 func (this *ReverseProxyBackend) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	this.Count += 1
-	log.Printf("[REVERSE STREAM][%s] %s >>>> %s [W %d]", req.Method, req.URL, this.rawBack, this.Weight)
-	this.proxy.ServeHTTP(rw, req)
+	log.Printf("[REVERSE STREAM][%s] %s >>>> %s [W %d]%s", req.Method, req.URL, this.rawBack, this.Weight(), this.groupSuffix())
+
+	if this.group != "" {
+		rw.Header().Set(TierHeader, this.group)
+	}
+
+	if this.breaker != nil {
+		if ok, reason := this.breaker.allow(); !ok {
+			log.Printf("[BREAKER][%s] short-circuited: %s", this.rawBack, reason)
+			WriteError(rw, req, http.StatusServiceUnavailable, codes.Unavailable, fmt.Sprintf("backend %s: %s", this.rawBack, reason))
+			return
+		}
+	}
+
+	this.requests.Add(1)
+	this.inflight.Add(1)
+
+	w := &responseWriter{
+		ResponseWriter: rw,
+	}
+
+	start := time.Now()
+	defer func() {
+		this.inflight.Add(-1)
+
+		outcome := Outcome{
+			StatusCode: w.status,
+			GRPCCode:   grpcCode(rw.Header()),
+			Err:        w.err,
+			Duration:   time.Since(start),
+		}
+
+		if !w.headerAt.IsZero() {
+			outcome.HeaderDuration = w.headerAt.Sub(start)
+		}
+
+		if this.breaker != nil {
+			this.breaker.done(outcome)
+		}
+
+		this.observe(outcome)
+	}()
+
+	this.proxy.ServeHTTP(w, req)
+}
+
+// Addr returns the backend address as configured.
+func (this *ReverseProxyBackend) Addr() string {
+	return this.rawBack
+}
+
+// Group returns the name of the priority group the backend belongs to, if
+// any.
+func (this *ReverseProxyBackend) Group() string {
+	return this.group
+}
+
+func (this *ReverseProxyBackend) setGroup(group string) {
+	this.group = group
+}
+
+func (this *ReverseProxyBackend) groupSuffix() string {
+	if this.group == "" {
+		return ""
+	}
+
+	return " [T " + this.group + "]"
+}
+
+// Weight returns the configured weight of the backend.
+func (this *ReverseProxyBackend) Weight() int {
+	return int(this.weight.Load())
+}
+
+// SetWeight changes the weight of the backend at runtime. Weights below 1
+// are raised to 1. Balancers which precompute their state from weights,
+// like ring hash and maglev, only see the change once rebuilt.
+func (this *ReverseProxyBackend) SetWeight(weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+
+	this.weight.Store(int64(weight))
+}
+
+// InFlight returns the number of requests and streams the backend is
+// currently serving.
+func (this *ReverseProxyBackend) InFlight() int64 {
+	return this.inflight.Load()
+}
+
+// Requests returns the number of requests forwarded to the backend so far.
+func (this *ReverseProxyBackend) Requests() int64 {
+	return this.requests.Load()
+}
+
+// AddObserver registers o to be notified of every finished request.
+func (this *ReverseProxyBackend) AddObserver(o Observer) {
+	this.observerMu.Lock()
+	defer this.observerMu.Unlock()
+
+	this.observers = append(this.observers, o)
+}
+
+func (this *ReverseProxyBackend) RemoveObserver(o Observer) {
+	this.observerMu.Lock()
+	defer this.observerMu.Unlock()
+
+	observers := make([]Observer, 0, len(this.observers))
+	for _, one := range this.observers {
+		if one != o {
+			observers = append(observers, one)
+		}
+	}
+
+	this.observers = observers
+}
+
+func (this *ReverseProxyBackend) observe(outcome Outcome) {
+	this.observerMu.RLock()
+	observers := this.observers
+	this.observerMu.RUnlock()
+
+	for _, o := range observers {
+		o.Observe(this, outcome)
+	}
+}
+
+// Healthy reports whether the last health transition left the backend healthy.
+func (this *ReverseProxyBackend) Healthy() bool {
+	this.healthMu.RLock()
+	defer this.healthMu.RUnlock()
+
+	return this.health.Healthy
+}
+
+// Available reports whether balancers may pick the backend.
+func (this *ReverseProxyBackend) Available() bool {
+	this.healthMu.RLock()
+	available := !this.retired && this.health.Healthy && (!this.health.Ejected || time.Now().After(this.health.EjectedUntil))
+	this.healthMu.RUnlock()
+
+	if available && this.breaker != nil {
+		return this.breaker.Available()
+	}
+
+	return available
+}
+
+// HealthStatus returns the current health state and the reason of the last transition.
+func (this *ReverseProxyBackend) HealthStatus() HealthStatus {
+	this.healthMu.RLock()
+	status := this.health
+	this.healthMu.RUnlock()
+
+	if this.breaker != nil {
+		status.Breaker = this.breaker.State()
+	}
+
+	return status
+}
+
+// Retire takes the backend out of rotation for good, once discovery no
+// longer lists it. Requests already in flight are left to finish.
+func (this *ReverseProxyBackend) Retire() {
+	this.healthMu.Lock()
+	defer this.healthMu.Unlock()
+
+	if !this.retired {
+		log.Printf("[DISCOVERY][%s] retired", this.rawBack)
+		this.retired = true
+	}
+}
+
+// SetBreaker puts the backend behind a circuit breaker.
+// It must be called before the backend starts serving requests.
+func (this *ReverseProxyBackend) SetBreaker(breaker *Breaker) {
+	this.breaker = breaker
+}
+
+func (this *ReverseProxyBackend) setHealthy(healthy bool, reason string) {
+	this.healthMu.Lock()
+	defer this.healthMu.Unlock()
+
+	if this.health.Healthy == healthy {
+		return
+	}
+
+	log.Printf("[HEALTH][%s] healthy %v => %v: %s", this.rawBack, this.health.Healthy, healthy, reason)
+
+	// ejection is tracked apart, by the outlier detector
+	this.health.Healthy = healthy
+	this.health.Reason = reason
+	this.health.Since = time.Now()
+
+	if healthy {
+		this.warmSince = this.health.Since
+	}
+}
+
+func (this *ReverseProxyBackend) setEjected(until time.Time, reason string) {
+	this.healthMu.Lock()
+	defer this.healthMu.Unlock()
+
+	log.Printf("[OUTLIER][%s] ejected until %s: %s", this.rawBack, until.Format(time.RFC3339), reason)
+
+	this.health.Ejected = true
+	this.health.EjectedUntil = until
+	this.health.EjectReason = reason
+
+	// the backend ramps up again once the ejection runs out
+	this.warmSince = until
+}
+
+func (this *ReverseProxyBackend) clearEjected() {
+	this.healthMu.Lock()
+	defer this.healthMu.Unlock()
+
+	if !this.health.Ejected {
+		return
+	}
+
+	log.Printf("[OUTLIER][%s] returned to service", this.rawBack)
+
+	this.health.Ejected = false
+	this.health.EjectedUntil = time.Time{}
+	this.health.EjectReason = ""
+}
+
+// proxyErrorHandler answers requests which could not be proxied with a
+// proper grpc status, or an http status for non grpc requests, and records
+// the error so that it shows up in the request's Outcome.
+func proxyErrorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	log.Printf("http: proxy error: %v", err)
+
+	if w, ok := rw.(*responseWriter); ok {
+		w.err = err
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		WriteError(rw, req, http.StatusGatewayTimeout, codes.DeadlineExceeded, "upstream request timeout")
+
+	case errors.Is(err, context.Canceled):
+		// a per-try timeout is not the caller's deadline, report it as
+		// UNAVAILABLE so that it may be retried
+		if cause := context.Cause(req.Context()); cause == errPerTryTimeout {
+			WriteError(rw, req, http.StatusGatewayTimeout, codes.Unavailable, cause.Error())
+			return
+		}
+
+		WriteError(rw, req, http.StatusBadGateway, codes.Canceled, "request canceled")
+
+	default:
+		WriteError(rw, req, http.StatusBadGateway, codes.Unavailable, fmt.Sprintf("upstream unavailable: %s", err))
+	}
 }
 
 func (this *ReverseProxyBackend) String() string {
-	return fmt.Sprintf("%s [W %d]", this.rawBack, this.Weight)
+	return fmt.Sprintf("%s [W %d]", this.rawBack, this.Weight())
 }
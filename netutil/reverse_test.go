@@ -0,0 +1,32 @@
+package netutil
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSetHealthyKeepsEjection(t *testing.T) {
+	target, _ := url.Parse("http://127.0.0.1:8000")
+	backend := NewReverseProxyBackend("127.0.0.1:8000", target, 1, http.DefaultTransport)
+
+	until := time.Now().Add(time.Minute)
+	backend.setEjected(until, "5 consecutive failures")
+
+	backend.setHealthy(false, "not serving")
+	backend.setHealthy(true, "serving")
+
+	status := backend.HealthStatus()
+	if !status.Healthy || status.Reason != "serving" {
+		t.Fatalf("health = %v %q, want healthy", status.Healthy, status.Reason)
+	}
+
+	if !status.Ejected || !status.EjectedUntil.Equal(until) || status.EjectReason != "5 consecutive failures" {
+		t.Fatalf("ejection lost: %+v", status)
+	}
+
+	if backend.Available() {
+		t.Fatalf("ejected backend available")
+	}
+}
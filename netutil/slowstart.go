@@ -0,0 +1,96 @@
+package netutil
+
+import (
+	"math"
+	"time"
+)
+
+// weightScale keeps the precision of ramped weights in integer arithmetic.
+const weightScale = 1000
+
+type SlowStartOpt struct {
+	// Window is how long a backend takes to ramp up to its full weight
+	// after it is added or returns to service. Zero disables slow start.
+	Window time.Duration
+
+	// Aggression shapes the ramp: 1 is linear, above 1 ramps up faster
+	// early on and below 1 holds the weight low for longer.
+	Aggression float64
+
+	// MinWeightPercent is the share of its weight a backend starts with.
+	MinWeightPercent int
+}
+
+func (this SlowStartOpt) withDefaults() SlowStartOpt {
+	if this.Aggression <= 0 {
+		this.Aggression = 1
+	}
+
+	if this.MinWeightPercent <= 0 {
+		this.MinWeightPercent = 10
+	}
+
+	if this.MinWeightPercent > 100 {
+		this.MinWeightPercent = 100
+	}
+
+	return this
+}
+
+// SetSlowStart ramps the backend's weight up after it is added or returns
+// to service. It must be called before the backend starts serving requests.
+func (this *ReverseProxyBackend) SetSlowStart(opt SlowStartOpt) {
+	this.slowStart = opt.withDefaults()
+}
+
+// InheritWarmup carries the slow start progress of prev, the same backend
+// in a configuration being replaced, over to this one, so a reload only
+// ramps up backends which are actually new.
+func (this *ReverseProxyBackend) InheritWarmup(prev *ReverseProxyBackend) {
+	prev.healthMu.RLock()
+	since := prev.warmSince
+	prev.healthMu.RUnlock()
+
+	this.healthMu.Lock()
+	this.warmSince = since
+	this.healthMu.Unlock()
+}
+
+// warmup returns the fraction of its weight the backend currently gets,
+// in (0, 1].
+func (this *ReverseProxyBackend) warmup() float64 {
+	opt := this.slowStart
+	if opt.Window <= 0 {
+		return 1
+	}
+
+	this.healthMu.RLock()
+	elapsed := time.Since(this.warmSince)
+	this.healthMu.RUnlock()
+
+	if elapsed >= opt.Window {
+		return 1
+	}
+
+	min := float64(opt.MinWeightPercent) / 100
+	if elapsed <= 0 {
+		return min
+	}
+
+	return math.Max(min, math.Pow(float64(elapsed)/float64(opt.Window), 1/opt.Aggression))
+}
+
+// effectiveWeight is the weight balancers work with, scaled by weightScale
+// and reduced while the backend is ramping up.
+func (this *ReverseProxyBackend) effectiveWeight() int {
+	weight := this.Weight() * weightScale
+
+	if f := this.warmup(); f < 1 {
+		weight = int(float64(weight) * f)
+		if weight < 1 {
+			weight = 1
+		}
+	}
+
+	return weight
+}
@@ -0,0 +1,194 @@
+package netutil
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	_ Balancer = &reverseSplit{}
+	_ Observer = &reverseSplit{}
+	_ Splitter = &reverseSplit{}
+)
+
+// Splitter is implemented by balancers which split traffic across weighted
+// clusters, and lets their weights be changed at runtime.
+type Splitter interface {
+	Weights() []ClusterWeight
+	SetWeights(weights map[string]int) error
+}
+
+type ClusterWeight struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// SplitCluster is a named set of backends with its own balancer, taking
+// Weight parts of the traffic.
+type SplitCluster struct {
+	Name     string
+	Weight   int
+	Backends []*ReverseProxyBackend
+	Balancer Balancer
+}
+
+// Split sends each request to one of clusters in proportion to their
+// weights. With a key, the cluster is chosen by the key's hash rather than
+// at random, so a key keeps landing in the same cluster. Every cluster
+// owns a contiguous range of hashes in declaration order: moving weight
+// from the first clusters to the last, as a canary rollout does, only
+// moves keys towards the last clusters.
+func Split(clusters []SplitCluster, key HashKey) (*reverseSplit, error) {
+	if len(clusters) == 0 {
+		return nil, errBackendsRequired
+	}
+
+	split := &reverseSplit{
+		clusters: clusters,
+		key:      key,
+		groupOf:  make(map[*ReverseProxyBackend]int),
+	}
+
+	weights := make(map[string]int, len(clusters))
+	for i, cluster := range clusters {
+		if len(cluster.Backends) == 0 || cluster.Balancer == nil {
+			return nil, fmt.Errorf("cluster %q: %s", cluster.Name, errBackendsRequired)
+		}
+
+		if _, dup := weights[cluster.Name]; dup {
+			return nil, fmt.Errorf("cluster %q declared twice", cluster.Name)
+		}
+
+		weights[cluster.Name] = cluster.Weight
+		for _, backend := range cluster.Backends {
+			split.groupOf[backend] = i
+		}
+	}
+
+	if err := split.SetWeights(weights); err != nil {
+		return nil, err
+	}
+
+	return split, nil
+}
+
+type reverseSplit struct {
+	clusters []SplitCluster
+	key      HashKey
+	groupOf  map[*ReverseProxyBackend]int
+
+	mu      sync.RWMutex
+	weights []int
+	total   int
+}
+
+func (this *reverseSplit) Pick(req *http.Request) http.Handler {
+	this.mu.RLock()
+	weights, total := this.weights, this.total
+	this.mu.RUnlock()
+
+	var point int
+	if this.key != nil {
+		point = int(hash64(this.key(req)) % uint64(total))
+	} else {
+		point = rand.Intn(total)
+	}
+
+	for i, weight := range weights {
+		if point < weight {
+			return this.clusters[i].Balancer.Pick(req)
+		}
+
+		point -= weight
+	}
+
+	return this.clusters[len(this.clusters)-1].Balancer.Pick(req)
+}
+
+// Weights returns the current weight of every cluster, in declaration order.
+func (this *reverseSplit) Weights() []ClusterWeight {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	weights := make([]ClusterWeight, len(this.clusters))
+	for i, cluster := range this.clusters {
+		weights[i] = ClusterWeight{
+			Name:   cluster.Name,
+			Weight: this.weights[i],
+		}
+	}
+
+	return weights
+}
+
+// SetWeights changes the weights of the named clusters, keeping the others.
+// Either all changes apply or none does.
+func (this *reverseSplit) SetWeights(weights map[string]int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	next := make([]int, len(this.clusters))
+	copy(next, this.weights)
+
+	for name, weight := range weights {
+		i := this.index(name)
+		if i < 0 {
+			return fmt.Errorf("unknown cluster %q", name)
+		}
+
+		if weight < 0 {
+			return fmt.Errorf("cluster %q: weight must not be negative", name)
+		}
+
+		next[i] = weight
+	}
+
+	total := 0
+	for _, weight := range next {
+		total += weight
+	}
+
+	if total == 0 {
+		return fmt.Errorf("at least one cluster needs a positive weight")
+	}
+
+	this.weights, this.total = next, total
+	return nil
+}
+
+func (this *reverseSplit) index(name string) int {
+	for i, cluster := range this.clusters {
+		if cluster.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Observe forwards outcomes to the balancer of the backend's cluster, for
+// policies which learn from them.
+func (this *reverseSplit) Observe(backend *ReverseProxyBackend, outcome Outcome) {
+	i, ok := this.groupOf[backend]
+	if !ok {
+		return
+	}
+
+	if observer, ok := this.clusters[i].Balancer.(Observer); ok {
+		observer.Observe(backend, outcome)
+	}
+}
+
+func (this *reverseSplit) String() string {
+	weights := this.Weights()
+
+	clusters := make([]string, len(this.clusters))
+	for i, cluster := range this.clusters {
+		clusters[i] = fmt.Sprintf("%s %d: %v", cluster.Name, weights[i].Weight, cluster.Balancer)
+	}
+
+	return fmt.Sprintf("[SPLIT] clusters [%s]", strings.Join(clusters, "; "))
+}
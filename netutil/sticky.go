@@ -0,0 +1,280 @@
+package netutil
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	_ Balancer = &reverseSticky{}
+	_ Observer = &reverseSticky{}
+)
+
+const (
+	DefaultAffinityHeader = "X-Grpcproxy-Affinity"
+	DefaultAffinityCookie = "grpcproxy-affinity"
+)
+
+type StickyOpt struct {
+	// Key is the request header, or grpc metadata key, carrying the
+	// client's session key. Sessions are pinned to the backend the
+	// balancer picked for their first request.
+	//
+	// When Key is empty, the proxy issues its own affinity token naming
+	// the backend instead: in the Header response header, which grpc
+	// clients are expected to send back as request metadata, and in the
+	// Cookie cookie for plain http clients.
+	Key string
+
+	Header string
+	Cookie string
+
+	// TTL is how long an idle session stays pinned, MaxSessions how many
+	// sessions are remembered. Both only apply to Key.
+	TTL         time.Duration
+	MaxSessions int
+}
+
+func (this StickyOpt) withDefaults() StickyOpt {
+	if this.Header == "" {
+		this.Header = DefaultAffinityHeader
+	}
+
+	if this.Cookie == "" {
+		this.Cookie = DefaultAffinityCookie
+	}
+
+	if this.TTL <= 0 {
+		this.TTL = 30 * time.Minute
+	}
+
+	if this.MaxSessions <= 0 {
+		this.MaxSessions = 65536
+	}
+
+	return this
+}
+
+// Sticky pins sessions to backends on top of balancer, which picks the
+// backend of a new session and of sessions whose backend is unavailable
+// or gone.
+func Sticky(balancer Balancer, backends []*ReverseProxyBackend, opt StickyOpt) (*reverseSticky, error) {
+	if len(backends) == 0 {
+		return nil, errBackendsRequired
+	}
+
+	opt = opt.withDefaults()
+
+	sticky := &reverseSticky{
+		opt:      opt,
+		balancer: balancer,
+		byToken:  make(map[string]*ReverseProxyBackend, len(backends)),
+		handlers: make(map[http.Handler]http.Handler, len(backends)),
+		sessions: make(map[string]*stickySession),
+	}
+
+	for _, backend := range backends {
+		sticky.byToken[affinityToken(backend)] = backend
+
+		// issue the token through stable per backend handlers, callers
+		// like Retry tell attempts apart by handler
+		if opt.Key == "" {
+			sticky.handlers[backend] = &affinityHandler{
+				opt:     opt,
+				token:   affinityToken(backend),
+				backend: backend,
+			}
+		}
+	}
+
+	return sticky, nil
+}
+
+type reverseSticky struct {
+	opt      StickyOpt
+	balancer Balancer
+
+	byToken  map[string]*ReverseProxyBackend
+	handlers map[http.Handler]http.Handler
+
+	mu       sync.Mutex
+	sessions map[string]*stickySession
+}
+
+type stickySession struct {
+	backend  *ReverseProxyBackend
+	lastSeen time.Time
+}
+
+// affinityToken names a backend by its address, so that tokens issued
+// before a reload keep working as long as the backend stays configured.
+func affinityToken(backend *ReverseProxyBackend) string {
+	return strconv.FormatUint(hash64(backend.Addr()), 36)
+}
+
+func (this *reverseSticky) Pick(req *http.Request) http.Handler {
+	if this.opt.Key != "" {
+		return this.pickSession(req)
+	}
+
+	token := req.Header.Get(this.opt.Header)
+	if token == "" {
+		if cookie, err := req.Cookie(this.opt.Cookie); err == nil {
+			token = cookie.Value
+		}
+	}
+
+	if backend, ok := this.byToken[token]; ok && backend.Available() {
+		return this.handler(backend)
+	}
+
+	return this.handler(this.balancer.Pick(req))
+}
+
+func (this *reverseSticky) pickSession(req *http.Request) http.Handler {
+	key := req.Header.Get(this.opt.Key)
+	if key == "" {
+		return this.balancer.Pick(req)
+	}
+
+	now := time.Now()
+
+	this.mu.Lock()
+	session, ok := this.sessions[key]
+	if ok && now.Sub(session.lastSeen) < this.opt.TTL && session.backend.Available() {
+		session.lastSeen = now
+		this.mu.Unlock()
+		return session.backend
+	}
+	this.mu.Unlock()
+
+	h := this.balancer.Pick(req)
+
+	backend, ok := h.(*ReverseProxyBackend)
+	if !ok {
+		return h
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, ok := this.sessions[key]; !ok && len(this.sessions) >= this.opt.MaxSessions {
+		this.evict(now)
+	}
+
+	this.sessions[key] = &stickySession{
+		backend:  backend,
+		lastSeen: now,
+	}
+
+	return backend
+}
+
+// evict drops expired sessions, or an arbitrary one if none has expired.
+func (this *reverseSticky) evict(now time.Time) {
+	for key, session := range this.sessions {
+		if now.Sub(session.lastSeen) >= this.opt.TTL {
+			delete(this.sessions, key)
+		}
+	}
+
+	if len(this.sessions) < this.opt.MaxSessions {
+		return
+	}
+
+	for key := range this.sessions {
+		delete(this.sessions, key)
+		return
+	}
+}
+
+func (this *reverseSticky) handler(h http.Handler) http.Handler {
+	if wrapped, ok := this.handlers[h]; ok {
+		return wrapped
+	}
+
+	return h
+}
+
+// InheritSessions hands the sessions of prev, the balancer of a
+// configuration being replaced, over to balancer, as far as their backends
+// are still configured. It does nothing unless both are sticky.
+func InheritSessions(balancer, prev Balancer) {
+	sticky, ok := balancer.(*reverseSticky)
+	if !ok {
+		return
+	}
+
+	if prev, ok := prev.(*reverseSticky); ok && sticky.opt.Key != "" && sticky.opt.Key == prev.opt.Key {
+		sticky.inherit(prev)
+	}
+}
+
+func (this *reverseSticky) inherit(prev *reverseSticky) {
+	byAddr := make(map[string]*ReverseProxyBackend, len(this.byToken))
+	for _, backend := range this.byToken {
+		byAddr[backend.Addr()] = backend
+	}
+
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for key, session := range prev.sessions {
+		if backend, ok := byAddr[session.backend.Addr()]; ok {
+			this.sessions[key] = &stickySession{
+				backend:  backend,
+				lastSeen: session.lastSeen,
+			}
+		}
+	}
+
+	log.Printf("[STICKY] %d of %d sessions kept", len(this.sessions), len(prev.sessions))
+}
+
+// Observe forwards outcomes to the underlying balancer, for policies which
+// learn from them.
+func (this *reverseSticky) Observe(backend *ReverseProxyBackend, outcome Outcome) {
+	if observer, ok := this.balancer.(Observer); ok {
+		observer.Observe(backend, outcome)
+	}
+}
+
+func (this *reverseSticky) String() string {
+	if this.opt.Key != "" {
+		return fmt.Sprintf("[STICKY] key %s, ttl %s over %v", this.opt.Key, this.opt.TTL, this.balancer)
+	}
+
+	return fmt.Sprintf("[STICKY] header %s, cookie %s over %v", this.opt.Header, this.opt.Cookie, this.balancer)
+}
+
+// affinityHandler serves the request with its backend and hands out the
+// backend's token, unless the client already presented it.
+type affinityHandler struct {
+	opt     StickyOpt
+	token   string
+	backend *ReverseProxyBackend
+}
+
+func (this *affinityHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if IsGRPCRequest(req) {
+		if req.Header.Get(this.opt.Header) != this.token {
+			rw.Header().Set(this.opt.Header, this.token)
+		}
+	} else if cookie, err := req.Cookie(this.opt.Cookie); err != nil || cookie.Value != this.token {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     this.opt.Cookie,
+			Value:    this.token,
+			Path:     "/",
+			HttpOnly: true,
+		})
+	}
+
+	this.backend.ServeHTTP(rw, req)
+}
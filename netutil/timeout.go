@@ -0,0 +1,61 @@
+package netutil
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const GRPCTimeoutHeader = "Grpc-Timeout"
+
+var grpcTimeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// ParseGRPCTimeout parses a grpc-timeout header value such as "100m".
+func ParseGRPCTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+
+	for _, one := range grpcTimeoutUnits {
+		if one.unit == s[len(s)-1] {
+			if max := int64(1<<63-1) / int64(one.d); n > max {
+				n = max
+			}
+
+			return time.Duration(n) * one.d, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid grpc-timeout unit in %q", s)
+}
+
+// EncodeGRPCTimeout formats d with the finest unit that fits in the
+// 8 digits allowed by the grpc spec.
+func EncodeGRPCTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+
+	for _, one := range grpcTimeoutUnits {
+		if v := (d + one.d - 1) / one.d; v < 1e8 {
+			return strconv.FormatInt(int64(v), 10) + string(one.unit)
+		}
+	}
+
+	return "99999999H"
+}
@@ -0,0 +1,781 @@
+package netutil
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointpb "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	XDSClusterType  = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	XDSEndpointType = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+	XDSRouteType    = "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"
+)
+
+// xdsPolicies maps the cds load balancing policies to balancers. Other
+// policies fall back to the default balancer.
+var xdsPolicies = map[clusterpb.Cluster_LbPolicy]string{
+	clusterpb.Cluster_ROUND_ROBIN:   "round",
+	clusterpb.Cluster_LEAST_REQUEST: "least",
+	clusterpb.Cluster_RANDOM:        "random",
+}
+
+type XDSOpt struct {
+	// Address of the control plane, dialed over plain text unless TLS.
+	Address string
+	TLS     bool
+
+	// NodeID and NodeCluster identify the proxy to the control plane.
+	NodeID      string
+	NodeCluster string
+
+	// RouteConfigs are the names of the route configurations to request
+	// over rds, none are requested if empty.
+	RouteConfigs []string
+
+	// RetryBase and RetryMax bound the exponential backoff between
+	// attempts to open the stream.
+	RetryBase time.Duration
+	RetryMax  time.Duration
+}
+
+func (this XDSOpt) withDefaults() XDSOpt {
+	if this.RetryBase <= 0 {
+		this.RetryBase = time.Second
+	}
+
+	if this.RetryMax < this.RetryBase {
+		this.RetryMax = 30 * this.RetryBase
+	}
+
+	return this
+}
+
+// XDSCluster is a cluster received over cds.
+type XDSCluster struct {
+	Name   string
+	Policy string
+	TLS    bool
+
+	// eds is the name endpoints are requested under over eds, empty for
+	// clusters listing their endpoints in static.
+	eds    string
+	static []Target
+}
+
+// XDSVirtualHost is a virtual host of a route configuration received over
+// rds, its routes in match order.
+type XDSVirtualHost struct {
+	Name    string
+	Domains []string
+	Routes  []XDSRoute
+}
+
+// XDSRoute sends the requests matching Prefix, or Path exactly, and
+// Headers to Cluster.
+type XDSRoute struct {
+	Name    string
+	Prefix  string
+	Path    string
+	Headers []XDSHeaderMatch
+	Cluster string
+	Timeout time.Duration
+}
+
+type XDSHeaderMatch struct {
+	Name string
+	HeaderMatchOpt
+}
+
+// NewXDSClient returns a client of the aggregated discovery service of an
+// envoy style control plane. It requests every cluster over cds, the
+// endpoints of the eds clusters, and opt.RouteConfigs over rds, on a
+// single stream opened by Run.
+func NewXDSClient(opt XDSOpt) (*XDSClient, error) {
+	opt = opt.withDefaults()
+
+	if opt.Address == "" {
+		return nil, fmt.Errorf("address required")
+	}
+
+	if opt.NodeID == "" {
+		return nil, fmt.Errorf("node id required")
+	}
+
+	creds := insecure.NewCredentials()
+	if opt.TLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+
+	conn, err := grpc.NewClient(opt.Address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &XDSClient{
+		opt:    opt,
+		conn:   conn,
+		ctx:    ctx,
+		cancel: cancel,
+
+		versions:     make(map[string]string),
+		nonces:       make(map[string]string),
+		clusters:     make(map[string]XDSCluster),
+		endpoints:    make(map[string][]Target),
+		routeConfigs: make(map[string][]XDSVirtualHost),
+		watchers:     make(map[string]map[*xdsWatch]bool),
+		changed:      make(chan struct{}, 1),
+	}, nil
+}
+
+type XDSClient struct {
+	opt    XDSOpt
+	conn   *grpc.ClientConn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards everything below, and is held while sending on the stream
+	// and calling watchers, so that they see updates in order
+	mu       sync.Mutex
+	stream   discoverypb.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	versions map[string]string
+	nonces   map[string]string
+	edsNames []string
+
+	clusters     map[string]XDSCluster
+	endpoints    map[string][]Target
+	routeConfigs map[string][]XDSVirtualHost
+	watchers     map[string]map[*xdsWatch]bool
+
+	changed chan struct{}
+}
+
+type xdsWatch struct {
+	update func([]Target)
+}
+
+// WatchCluster calls update with the endpoints of cluster, right away if
+// they are known, then every time they change until the returned func is
+// called.
+func (this *XDSClient) WatchCluster(cluster string, update func([]Target)) func() {
+	watch := &xdsWatch{
+		update: update,
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.watchers[cluster] == nil {
+		this.watchers[cluster] = make(map[*xdsWatch]bool)
+	}
+
+	this.watchers[cluster][watch] = true
+
+	// a failed send breaks the stream, the next one subscribes again
+	this.subscribeEndpoints()
+
+	if targets, ok := this.targets(cluster); ok {
+		update(targets)
+	}
+
+	return func() {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+
+		delete(this.watchers[cluster], watch)
+		if len(this.watchers[cluster]) == 0 {
+			delete(this.watchers, cluster)
+		}
+	}
+}
+
+// Cluster returns the cluster named name, if it was received over cds.
+func (this *XDSClient) Cluster(name string) (XDSCluster, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	cluster, ok := this.clusters[name]
+	return cluster, ok
+}
+
+// Routes returns the virtual hosts of the route configurations received
+// so far, in the order of XDSOpt.RouteConfigs.
+func (this *XDSClient) Routes() []XDSVirtualHost {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	vhosts := make([]XDSVirtualHost, 0)
+	for _, name := range this.opt.RouteConfigs {
+		vhosts = append(vhosts, this.routeConfigs[name]...)
+	}
+
+	return vhosts
+}
+
+// Changed receives after the clusters or the routes change.
+func (this *XDSClient) Changed() <-chan struct{} {
+	return this.changed
+}
+
+// Run keeps the stream to the control plane open until Close is called.
+func (this *XDSClient) Run() {
+	backoff := time.Duration(0)
+
+	for {
+		received, err := this.serve()
+		if this.ctx.Err() != nil {
+			return
+		}
+
+		if received {
+			backoff = 0
+		}
+
+		if backoff *= 2; backoff < this.opt.RetryBase {
+			backoff = this.opt.RetryBase
+		}
+
+		if backoff > this.opt.RetryMax {
+			backoff = this.opt.RetryMax
+		}
+
+		log.Printf("[XDS][%s] stream failed, retry in %s: %s", this.opt.Address, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-this.ctx.Done():
+			timer.Stop()
+			return
+
+		case <-timer.C:
+		}
+	}
+}
+
+// serve runs one stream, reporting whether it received anything before it
+// failed.
+func (this *XDSClient) serve() (bool, error) {
+	stream, err := discoverypb.NewAggregatedDiscoveryServiceClient(this.conn).StreamAggregatedResources(this.ctx)
+	if err != nil {
+		return false, err
+	}
+
+	this.mu.Lock()
+	this.stream = stream
+	this.nonces = make(map[string]string)
+
+	err = this.send(XDSClusterType, nil)
+	if err == nil && len(this.opt.RouteConfigs) > 0 {
+		err = this.send(XDSRouteType, nil)
+	}
+
+	if err == nil && len(this.edsNames) > 0 {
+		err = this.send(XDSEndpointType, nil)
+	}
+
+	this.mu.Unlock()
+
+	defer func() {
+		this.mu.Lock()
+		this.stream = nil
+		this.mu.Unlock()
+	}()
+
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("[XDS][%s] stream opened for node %q", this.opt.Address, this.opt.NodeID)
+
+	received := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+
+		received = true
+		if err := this.handle(resp); err != nil {
+			return received, err
+		}
+	}
+}
+
+// handle applies a response and acks it, or nacks it if it can't be
+// applied, keeping the previous resources of its type.
+func (this *XDSClient) handle(resp *discoverypb.DiscoveryResponse) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var err error
+
+	switch resp.TypeUrl {
+	case XDSClusterType:
+		err = this.applyClusters(resp.Resources)
+
+	case XDSEndpointType:
+		err = this.applyEndpoints(resp.Resources)
+
+	case XDSRouteType:
+		err = this.applyRoutes(resp.Resources)
+
+	default:
+		log.Printf("[XDS][%s] ignore resources of type %s", this.opt.Address, resp.TypeUrl)
+		return nil
+	}
+
+	this.nonces[resp.TypeUrl] = resp.Nonce
+
+	if err != nil {
+		log.Printf("[XDS][%s] reject version %q of %s: %s", this.opt.Address, resp.VersionInfo, resp.TypeUrl, err)
+		return this.send(resp.TypeUrl, err)
+	}
+
+	log.Printf("[XDS][%s] accept version %q of %s, %d resources", this.opt.Address, resp.VersionInfo, resp.TypeUrl, len(resp.Resources))
+
+	this.versions[resp.TypeUrl] = resp.VersionInfo
+	if err := this.send(resp.TypeUrl, nil); err != nil {
+		return err
+	}
+
+	if resp.TypeUrl == XDSClusterType {
+		return this.subscribeEndpoints()
+	}
+
+	return nil
+}
+
+// send requests the resources of typeURL, acking the last response of
+// that type, or nacking it with nack. It must be called with mu held.
+func (this *XDSClient) send(typeURL string, nack error) error {
+	if this.stream == nil {
+		return nil
+	}
+
+	req := &discoverypb.DiscoveryRequest{
+		VersionInfo: this.versions[typeURL],
+		Node: &corepb.Node{
+			Id:      this.opt.NodeID,
+			Cluster: this.opt.NodeCluster,
+		},
+		TypeUrl:       typeURL,
+		ResponseNonce: this.nonces[typeURL],
+	}
+
+	switch typeURL {
+	case XDSEndpointType:
+		req.ResourceNames = this.edsNames
+
+	case XDSRouteType:
+		req.ResourceNames = this.opt.RouteConfigs
+	}
+
+	if nack != nil {
+		req.ErrorDetail = &statuspb.Status{
+			Code:    int32(codes.InvalidArgument),
+			Message: nack.Error(),
+		}
+	}
+
+	return this.stream.Send(req)
+}
+
+// subscribeEndpoints requests the endpoints of the eds clusters, and of
+// the watched clusters cds didn't list, if they changed. It must be called
+// with mu held.
+func (this *XDSClient) subscribeEndpoints() error {
+	names := make([]string, 0, len(this.clusters)+len(this.watchers))
+	for _, cluster := range this.clusters {
+		if cluster.eds != "" {
+			names = append(names, cluster.eds)
+		}
+	}
+
+	for name := range this.watchers {
+		if _, ok := this.clusters[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	if slices.Equal(names, this.edsNames) {
+		return nil
+	}
+
+	this.edsNames = names
+	return this.send(XDSEndpointType, nil)
+}
+
+// targets returns the endpoints of cluster, if they are known. It must be
+// called with mu held.
+func (this *XDSClient) targets(name string) ([]Target, bool) {
+	eds := name
+	if cluster, ok := this.clusters[name]; ok {
+		if cluster.eds == "" {
+			return cluster.static, true
+		}
+
+		eds = cluster.eds
+	}
+
+	targets, ok := this.endpoints[eds]
+	return targets, ok
+}
+
+// notify passes the endpoints of every watched cluster to its watchers.
+// It must be called with mu held.
+func (this *XDSClient) notify() {
+	for name, watches := range this.watchers {
+		targets, ok := this.targets(name)
+		if !ok {
+			continue
+		}
+
+		for watch := range watches {
+			watch.update(targets)
+		}
+	}
+}
+
+// changes signals Changed without blocking, one signal covers any number
+// of changes.
+func (this *XDSClient) changes() {
+	select {
+	case this.changed <- struct{}{}:
+	default:
+	}
+}
+
+// applyClusters replaces the clusters, cds always sends all of them.
+func (this *XDSClient) applyClusters(resources []*anypb.Any) error {
+	clusters := make(map[string]XDSCluster, len(resources))
+
+	for _, resource := range resources {
+		var pb clusterpb.Cluster
+		if err := resource.UnmarshalTo(&pb); err != nil {
+			return err
+		}
+
+		cluster := XDSCluster{
+			Name: pb.GetName(),
+			TLS:  pb.GetTransportSocket() != nil,
+		}
+
+		if policy, ok := xdsPolicies[pb.GetLbPolicy()]; ok {
+			cluster.Policy = policy
+		} else {
+			log.Printf("[XDS][%s] cluster %q: unsupported lb policy %s, use the default", this.opt.Address, cluster.Name, pb.GetLbPolicy())
+		}
+
+		if pb.GetType() == clusterpb.Cluster_EDS {
+			cluster.eds = pb.GetEdsClusterConfig().GetServiceName()
+			if cluster.eds == "" {
+				cluster.eds = cluster.Name
+			}
+		} else {
+			cluster.static = xdsTargets(pb.GetLoadAssignment())
+		}
+
+		clusters[cluster.Name] = cluster
+	}
+
+	this.clusters = clusters
+	this.notify()
+	this.changes()
+
+	return nil
+}
+
+// applyEndpoints updates the endpoints of the clusters in resources, eds
+// may leave the unchanged ones out.
+func (this *XDSClient) applyEndpoints(resources []*anypb.Any) error {
+	assignments := make([]*endpointpb.ClusterLoadAssignment, 0, len(resources))
+
+	for _, resource := range resources {
+		var pb endpointpb.ClusterLoadAssignment
+		if err := resource.UnmarshalTo(&pb); err != nil {
+			return err
+		}
+
+		assignments = append(assignments, &pb)
+	}
+
+	for _, pb := range assignments {
+		this.endpoints[pb.GetClusterName()] = xdsTargets(pb)
+	}
+
+	this.notify()
+
+	return nil
+}
+
+// applyRoutes updates the route configurations in resources.
+func (this *XDSClient) applyRoutes(resources []*anypb.Any) error {
+	configs := make(map[string][]XDSVirtualHost, len(resources))
+
+	for _, resource := range resources {
+		var pb routepb.RouteConfiguration
+		if err := resource.UnmarshalTo(&pb); err != nil {
+			return err
+		}
+
+		vhosts, err := xdsVirtualHosts(&pb)
+		if err != nil {
+			return fmt.Errorf("route configuration %q: %s", pb.GetName(), err)
+		}
+
+		configs[pb.GetName()] = vhosts
+	}
+
+	for name, vhosts := range configs {
+		this.routeConfigs[name] = vhosts
+	}
+
+	this.changes()
+
+	return nil
+}
+
+// Close stops Run and closes the connection to the control plane.
+func (this *XDSClient) Close() {
+	this.cancel()
+	this.conn.Close()
+}
+
+func (this *XDSClient) String() string {
+	return fmt.Sprintf("[XDS] %s as %q", this.opt.Address, this.opt.NodeID)
+}
+
+// xdsTargets lists the endpoints of an assignment. Endpoints which are
+// neither healthy, degraded nor of unknown health are unhealthy.
+func xdsTargets(pb *endpointpb.ClusterLoadAssignment) []Target {
+	targets := make([]Target, 0)
+
+	for _, locality := range pb.GetEndpoints() {
+		for _, lb := range locality.GetLbEndpoints() {
+			addr := lb.GetEndpoint().GetAddress().GetSocketAddress()
+			if addr == nil {
+				continue
+			}
+
+			weight := int(lb.GetLoadBalancingWeight().GetValue())
+			if weight < 1 {
+				weight = 1
+			}
+
+			health := lb.GetHealthStatus()
+
+			targets = append(targets, Target{
+				Addr:      net.JoinHostPort(addr.GetAddress(), strconv.Itoa(int(addr.GetPortValue()))),
+				Weight:    weight,
+				Priority:  int(locality.GetPriority()),
+				Unhealthy: health != corepb.HealthStatus_UNKNOWN && health != corepb.HealthStatus_HEALTHY && health != corepb.HealthStatus_DEGRADED,
+				Zone:      locality.GetLocality().GetZone(),
+			})
+		}
+	}
+
+	return targets
+}
+
+func xdsVirtualHosts(pb *routepb.RouteConfiguration) ([]XDSVirtualHost, error) {
+	vhosts := make([]XDSVirtualHost, 0, len(pb.GetVirtualHosts()))
+
+	for _, vh := range pb.GetVirtualHosts() {
+		vhost := XDSVirtualHost{
+			Name:    vh.GetName(),
+			Domains: vh.GetDomains(),
+		}
+
+		for i, r := range vh.GetRoutes() {
+			route, err := xdsRoute(r)
+			if err != nil {
+				return nil, fmt.Errorf("virtual host %q route #%d: %s", vh.GetName(), i, err)
+			}
+
+			vhost.Routes = append(vhost.Routes, route)
+		}
+
+		vhosts = append(vhosts, vhost)
+	}
+
+	return vhosts, nil
+}
+
+func xdsRoute(pb *routepb.Route) (XDSRoute, error) {
+	route := XDSRoute{
+		Name:    pb.GetName(),
+		Prefix:  pb.GetMatch().GetPrefix(),
+		Path:    pb.GetMatch().GetPath(),
+		Cluster: pb.GetRoute().GetCluster(),
+		Timeout: pb.GetRoute().GetTimeout().AsDuration(),
+	}
+
+	switch pb.GetMatch().GetPathSpecifier().(type) {
+	case *routepb.RouteMatch_Prefix, *routepb.RouteMatch_Path:
+
+	default:
+		return route, fmt.Errorf("only prefix and path matches are supported")
+	}
+
+	if route.Cluster == "" {
+		return route, fmt.Errorf("only routes to a single cluster are supported")
+	}
+
+	for _, h := range pb.GetMatch().GetHeaders() {
+		match := XDSHeaderMatch{
+			Name: h.GetName(),
+		}
+
+		sm := h.GetStringMatch()
+
+		switch {
+		case h.GetPresentMatch() && h.GetInvertMatch():
+			match.Absent = true
+
+		case h.GetPresentMatch():
+			match.Present = true
+
+		case h.GetInvertMatch():
+			return route, fmt.Errorf("header %q: inverted matches are not supported", h.GetName())
+
+		case h.GetExactMatch() != "" || sm.GetExact() != "":
+			match.Exact = h.GetExactMatch() + sm.GetExact()
+
+		case h.GetPrefixMatch() != "" || sm.GetPrefix() != "":
+			match.Prefix = h.GetPrefixMatch() + sm.GetPrefix()
+
+		case h.GetSafeRegexMatch() != nil || sm.GetSafeRegex() != nil:
+			match.Regex = h.GetSafeRegexMatch().GetRegex() + sm.GetSafeRegex().GetRegex()
+
+		default:
+			return route, fmt.Errorf("header %q: unsupported match", h.GetName())
+		}
+
+		route.Headers = append(route.Headers, match)
+	}
+
+	return route, nil
+}
+
+// NewXDSDiscovery watches the endpoints of cluster through client. Refresh
+// waits up to timeout for the first of them.
+func NewXDSDiscovery(client *XDSClient, cluster string, timeout time.Duration, update func([]Target)) *XDSDiscovery {
+	return &XDSDiscovery{
+		client:  client,
+		cluster: cluster,
+		timeout: timeout,
+		update:  update,
+		first:   make(chan struct{}),
+		closeCh: make(chan struct{}),
+	}
+}
+
+type XDSDiscovery struct {
+	client  *XDSClient
+	cluster string
+	timeout time.Duration
+	update  func([]Target)
+
+	mu     sync.Mutex
+	last   []Target
+	cancel func()
+
+	watchOnce sync.Once
+	firstOnce sync.Once
+	first     chan struct{}
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// Refresh starts watching the cluster, and waits for its first endpoints
+// if none were received yet.
+func (this *XDSDiscovery) Refresh() {
+	this.watchOnce.Do(func() {
+		cancel := this.client.WatchCluster(this.cluster, this.set)
+
+		this.mu.Lock()
+		this.cancel = cancel
+		this.mu.Unlock()
+	})
+
+	timer := time.NewTimer(this.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-this.first:
+
+	case <-this.closeCh:
+
+	case <-timer.C:
+		log.Printf("[XDS][%s] no endpoints received within %s", this.cluster, this.timeout)
+	}
+}
+
+func (this *XDSDiscovery) set(targets []Target) {
+	if len(targets) == 0 {
+		log.Printf("[XDS][%s] no endpoints, keeping the previous backends", this.cluster)
+		return
+	}
+
+	targets = slices.Clone(targets)
+	SortTargets(targets)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if EqualTargets(targets, this.last) {
+		return
+	}
+
+	log.Printf("[XDS][%s] found %v", this.cluster, targets)
+
+	this.last = targets
+	this.update(targets)
+
+	this.firstOnce.Do(func() {
+		close(this.first)
+	})
+}
+
+// Run blocks until Close is called, updates come from the client.
+func (this *XDSDiscovery) Run() {
+	<-this.closeCh
+}
+
+func (this *XDSDiscovery) Close() {
+	this.closeOnce.Do(func() {
+		close(this.closeCh)
+
+		this.mu.Lock()
+		cancel := this.cancel
+		this.mu.Unlock()
+
+		if cancel != nil {
+			cancel()
+		}
+	})
+}
@@ -0,0 +1,350 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointpb "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	matcherpb "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const xdsTestNode = "grpcproxy-test"
+
+// xdsControlPlane serves snapshots over ads on a local port, recording
+// the nacks it receives.
+type xdsControlPlane struct {
+	t     *testing.T
+	addr  string
+	cache cachev3.SnapshotCache
+
+	mu     sync.Mutex
+	server *grpc.Server
+	nacks  []*discoverypb.DiscoveryRequest
+}
+
+func newXDSControlPlane(t *testing.T) *xdsControlPlane {
+	cp := &xdsControlPlane{
+		t:     t,
+		addr:  "127.0.0.1:0",
+		cache: cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil),
+	}
+
+	cp.start()
+	t.Cleanup(cp.stop)
+
+	return cp
+}
+
+// start serves on the address of the previous server, if any.
+func (this *xdsControlPlane) start() {
+	listener, err := net.Listen("tcp", this.addr)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+
+	this.addr = listener.Addr().String()
+
+	callbacks := serverv3.CallbackFuncs{
+		StreamRequestFunc: func(_ int64, req *discoverypb.DiscoveryRequest) error {
+			if req.ErrorDetail != nil {
+				this.mu.Lock()
+				this.nacks = append(this.nacks, req)
+				this.mu.Unlock()
+			}
+
+			return nil
+		},
+	}
+
+	server := grpc.NewServer()
+	discoverypb.RegisterAggregatedDiscoveryServiceServer(server, serverv3.NewServer(context.Background(), this.cache, callbacks))
+
+	this.mu.Lock()
+	this.server = server
+	this.mu.Unlock()
+
+	go server.Serve(listener)
+}
+
+func (this *xdsControlPlane) stop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.server.Stop()
+}
+
+func (this *xdsControlPlane) nacked() []*discoverypb.DiscoveryRequest {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]*discoverypb.DiscoveryRequest(nil), this.nacks...)
+}
+
+func (this *xdsControlPlane) set(version string, resources map[resource.Type][]types.Resource) {
+	snapshot, err := cachev3.NewSnapshot(version, resources)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+
+	if err := this.cache.SetSnapshot(context.Background(), xdsTestNode, snapshot); err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+func xdsEndpoint(port uint32, weight uint32, health corepb.HealthStatus) *endpointpb.LbEndpoint {
+	return &endpointpb.LbEndpoint{
+		HostIdentifier: &endpointpb.LbEndpoint_Endpoint{
+			Endpoint: &endpointpb.Endpoint{
+				Address: &corepb.Address{
+					Address: &corepb.Address_SocketAddress{
+						SocketAddress: &corepb.SocketAddress{
+							Address:       "127.0.0.1",
+							PortSpecifier: &corepb.SocketAddress_PortValue{PortValue: port},
+						},
+					},
+				},
+			},
+		},
+		LoadBalancingWeight: wrapperspb.UInt32(weight),
+		HealthStatus:        health,
+	}
+}
+
+func xdsResources(endpoints []*endpointpb.LbEndpoint, routes ...*routepb.Route) map[resource.Type][]types.Resource {
+	cluster := &clusterpb.Cluster{
+		Name:                 "foo",
+		ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_EDS},
+		LbPolicy:             clusterpb.Cluster_LEAST_REQUEST,
+		EdsClusterConfig: &clusterpb.Cluster_EdsClusterConfig{
+			EdsConfig: &corepb.ConfigSource{
+				ConfigSourceSpecifier: &corepb.ConfigSource_Ads{},
+			},
+		},
+	}
+
+	assignment := &endpointpb.ClusterLoadAssignment{
+		ClusterName: "foo",
+		Endpoints: []*endpointpb.LocalityLbEndpoints{{
+			Locality:    &corepb.Locality{Zone: "z1"},
+			LbEndpoints: endpoints,
+		}},
+	}
+
+	config := &routepb.RouteConfiguration{
+		Name: "local_route",
+		VirtualHosts: []*routepb.VirtualHost{{
+			Name:    "vh",
+			Domains: []string{"*"},
+			Routes:  routes,
+		}},
+	}
+
+	return map[resource.Type][]types.Resource{
+		resource.ClusterType:  {cluster},
+		resource.EndpointType: {assignment},
+		resource.RouteType:    {config},
+	}
+}
+
+func xdsPrefixRoute(name, prefix string) *routepb.Route {
+	return &routepb.Route{
+		Name: name,
+		Match: &routepb.RouteMatch{
+			PathSpecifier: &routepb.RouteMatch_Prefix{Prefix: prefix},
+		},
+		Action: &routepb.Route_Route{
+			Route: &routepb.RouteAction{
+				ClusterSpecifier: &routepb.RouteAction_Cluster{Cluster: "foo"},
+			},
+		},
+	}
+}
+
+func xdsPathRoute(name, path string) *routepb.Route {
+	route := xdsPrefixRoute(name, "")
+	route.Match.PathSpecifier = &routepb.RouteMatch_Path{Path: path}
+	return route
+}
+
+func newTestXDSClient(t *testing.T, cp *xdsControlPlane) *XDSClient {
+	client, err := NewXDSClient(XDSOpt{
+		Address:      cp.addr,
+		NodeID:       xdsTestNode,
+		RouteConfigs: []string{"local_route"},
+		RetryBase:    10 * time.Millisecond,
+		RetryMax:     50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(client.Close)
+	go client.Run()
+
+	return client
+}
+
+func xdsRouteNames(client *XDSClient) []string {
+	names := make([]string, 0)
+	for _, vhost := range client.Routes() {
+		for _, route := range vhost.Routes {
+			names = append(names, route.Name)
+		}
+	}
+
+	return names
+}
+
+func TestXDSClientUpdates(t *testing.T) {
+	cp := newXDSControlPlane(t)
+	cp.set("1", xdsResources(
+		[]*endpointpb.LbEndpoint{xdsEndpoint(51001, 1, corepb.HealthStatus_HEALTHY)},
+		xdsPathRoute("method", "/rpc.Foo/Bar"),
+		xdsPrefixRoute("all", "/"),
+	))
+
+	client := newTestXDSClient(t, cp)
+
+	updates := &targetUpdates{}
+	cancel := client.WatchCluster("foo", updates.update)
+	defer cancel()
+
+	waitFor(t, func() bool {
+		return len(updates.all()) > 0 && len(client.Routes()) > 0
+	})
+
+	want := []Target{{Addr: "127.0.0.1:51001", Weight: 1, Zone: "z1"}}
+	if got := updates.all(); !EqualTargets(got[len(got)-1], want) {
+		t.Fatalf("endpoints = %v, want %v", got[len(got)-1], want)
+	}
+
+	if cluster, ok := client.Cluster("foo"); !ok || cluster.Policy != "least" {
+		t.Fatalf("cluster = %+v, %v", cluster, ok)
+	}
+
+	vhosts := client.Routes()
+	if len(vhosts) != 1 || len(vhosts[0].Routes) != 2 {
+		t.Fatalf("routes = %+v", vhosts)
+	}
+
+	if route := vhosts[0].Routes[0]; route.Path != "/rpc.Foo/Bar" || route.Prefix != "" || route.Cluster != "foo" {
+		t.Fatalf("path route = %+v", route)
+	}
+
+	// endpoints and routes follow the snapshots
+	cp.set("2", xdsResources(
+		[]*endpointpb.LbEndpoint{
+			xdsEndpoint(51001, 1, corepb.HealthStatus_DRAINING),
+			xdsEndpoint(51002, 3, corepb.HealthStatus_HEALTHY),
+		},
+		xdsPrefixRoute("all", "/"),
+	))
+
+	want = []Target{
+		{Addr: "127.0.0.1:51001", Weight: 1, Zone: "z1", Unhealthy: true},
+		{Addr: "127.0.0.1:51002", Weight: 3, Zone: "z1"},
+	}
+
+	waitFor(t, func() bool {
+		got := updates.all()
+		targets := append([]Target(nil), got[len(got)-1]...)
+		SortTargets(targets)
+
+		return EqualTargets(targets, want) && len(xdsRouteNames(client)) == 1
+	})
+
+	if nacks := cp.nacked(); len(nacks) > 0 {
+		t.Fatalf("unexpected nacks %v", nacks)
+	}
+}
+
+func TestXDSClientNack(t *testing.T) {
+	cp := newXDSControlPlane(t)
+	cp.set("1", xdsResources(
+		[]*endpointpb.LbEndpoint{xdsEndpoint(51001, 1, corepb.HealthStatus_HEALTHY)},
+		xdsPrefixRoute("all", "/"),
+	))
+
+	client := newTestXDSClient(t, cp)
+
+	waitFor(t, func() bool {
+		return len(xdsRouteNames(client)) == 1
+	})
+
+	// regex paths aren't supported, the whole version is rejected
+	bad := xdsPrefixRoute("regex", "")
+	bad.Match.PathSpecifier = &routepb.RouteMatch_SafeRegex{
+		SafeRegex: &matcherpb.RegexMatcher{Regex: "/rpc.Foo/.*"},
+	}
+
+	cp.set("2", xdsResources(
+		[]*endpointpb.LbEndpoint{xdsEndpoint(51001, 1, corepb.HealthStatus_HEALTHY)},
+		bad,
+		xdsPrefixRoute("all", "/"),
+	))
+
+	waitFor(t, func() bool {
+		return len(cp.nacked()) > 0
+	})
+
+	nack := cp.nacked()[0]
+	if nack.TypeUrl != XDSRouteType || nack.VersionInfo != "1" {
+		t.Fatalf("nack of %s version %q, want %s version 1", nack.TypeUrl, nack.VersionInfo, XDSRouteType)
+	}
+
+	if names := xdsRouteNames(client); len(names) != 1 || names[0] != "all" {
+		t.Fatalf("routes after the nack = %v, want the previous ones", names)
+	}
+}
+
+func TestXDSClientReconnect(t *testing.T) {
+	cp := newXDSControlPlane(t)
+	cp.set("1", xdsResources(
+		[]*endpointpb.LbEndpoint{xdsEndpoint(51001, 1, corepb.HealthStatus_HEALTHY)},
+		xdsPrefixRoute("all", "/"),
+	))
+
+	client := newTestXDSClient(t, cp)
+
+	updates := &targetUpdates{}
+	cancel := client.WatchCluster("foo", updates.update)
+	defer cancel()
+
+	waitFor(t, func() bool {
+		return len(updates.all()) > 0
+	})
+
+	// the endpoints are kept while the control plane is away
+	cp.stop()
+	n := len(updates.all())
+
+	time.Sleep(50 * time.Millisecond)
+	if got := updates.all(); len(got) != n {
+		t.Fatalf("updates while disconnected = %v", got[n:])
+	}
+
+	cp.set("2", xdsResources(
+		[]*endpointpb.LbEndpoint{xdsEndpoint(51002, 1, corepb.HealthStatus_HEALTHY)},
+		xdsPrefixRoute("all", "/"),
+	))
+	cp.start()
+
+	want := []Target{{Addr: "127.0.0.1:51002", Weight: 1, Zone: "z1"}}
+	waitFor(t, func() bool {
+		got := updates.all()
+		return EqualTargets(got[len(got)-1], want)
+	})
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dtynn/grpcproxy/netutil"
+)
+
+// NewAdmin returns the handler of the admin api:
+//
+//	GET /backends                        health, ejection, breaker state and load of every backend
+//	GET /splits                          cluster weights of every proxy splitting traffic
+//	PUT /splits?app=<app>&proxy=<proxy>  set cluster weights, e.g. {"stable": 90, "canary": 10}
+//
+// Changes made through the api last until the next reload.
+func NewAdmin(service *Service) *Admin {
+	admin := &Admin{
+		service: service,
+		mux:     http.NewServeMux(),
+	}
+
+	admin.mux.HandleFunc("/backends", admin.backends)
+	admin.mux.HandleFunc("/splits", admin.splits)
+
+	return admin
+}
+
+type Admin struct {
+	service *Service
+	mux     *http.ServeMux
+}
+
+type splitStatus struct {
+	App      string                  `json:"app"`
+	Proxy    string                  `json:"proxy"`
+	Clusters []netutil.ClusterWeight `json:"clusters"`
+}
+
+type proxyStatus struct {
+	App      string          `json:"app"`
+	Proxy    string          `json:"proxy"`
+	Backends []backendStatus `json:"backends"`
+}
+
+type backendStatus struct {
+	Address  string    `json:"address"`
+	Group    string    `json:"group,omitempty"`
+	Weight   int       `json:"weight"`
+	Healthy  bool      `json:"healthy"`
+	Reason   string    `json:"reason,omitempty"`
+	Since    time.Time `json:"since"`
+	InFlight int64     `json:"inflight"`
+	Requests int64     `json:"requests"`
+
+	Ejected      bool       `json:"ejected,omitempty"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	EjectReason  string     `json:"eject_reason,omitempty"`
+
+	Breaker string `json:"breaker,omitempty"`
+}
+
+func (this *Admin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	this.mux.ServeHTTP(rw, req)
+}
+
+func (this *Admin) backends(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := make([]proxyStatus, 0)
+	for _, app := range this.service.Apps() {
+		for _, proxy := range app.Proxy {
+			one := proxyStatus{
+				App:      app.cfg.Name,
+				Proxy:    proxy.cfg.Name,
+				Backends: make([]backendStatus, 0),
+			}
+
+			for _, backend := range proxy.currentBackends() {
+				health := backend.HealthStatus()
+
+				bs := backendStatus{
+					Address:  backend.Addr(),
+					Group:    backend.Group(),
+					Weight:   backend.Weight(),
+					Healthy:  health.Healthy,
+					Reason:   health.Reason,
+					Since:    health.Since,
+					InFlight: backend.InFlight(),
+					Requests: backend.Requests(),
+
+					Ejected:     health.Ejected,
+					EjectReason: health.EjectReason,
+				}
+
+				if health.Ejected {
+					bs.EjectedUntil = &health.EjectedUntil
+				}
+
+				if proxy.cfg.CircuitBreaker != nil {
+					bs.Breaker = health.Breaker.String()
+				}
+
+				one.Backends = append(one.Backends, bs)
+			}
+
+			status = append(status, one)
+		}
+	}
+
+	writeJSON(rw, status)
+}
+
+func (this *Admin) splits(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		status := make([]splitStatus, 0)
+		for _, app := range this.service.Apps() {
+			for _, proxy := range app.Proxy {
+				if proxy.split != nil {
+					status = append(status, splitStatus{
+						App:      app.cfg.Name,
+						Proxy:    proxy.cfg.Name,
+						Clusters: proxy.split.Weights(),
+					})
+				}
+			}
+		}
+
+		writeJSON(rw, status)
+
+	case http.MethodPut, http.MethodPost:
+		appName, proxyName := req.URL.Query().Get("app"), req.URL.Query().Get("proxy")
+
+		proxy := this.service.findProxy(appName, proxyName)
+		if proxy == nil || proxy.split == nil {
+			http.Error(rw, fmt.Sprintf("no split proxy %q in app %q", proxyName, appName), http.StatusNotFound)
+			return
+		}
+
+		weights := map[string]int{}
+		if err := json.NewDecoder(req.Body).Decode(&weights); err != nil {
+			http.Error(rw, fmt.Sprintf("invalid weights: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := proxy.split.SetWeights(weights); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("[ADMIN][%s][%s] split weights set to %v", appName, proxyName, weights)
+
+		writeJSON(rw, splitStatus{
+			App:      appName,
+			Proxy:    proxyName,
+			Clusters: proxy.split.Weights(),
+		})
+
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
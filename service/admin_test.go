@@ -0,0 +1,81 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dtynn/grpcproxy/config"
+)
+
+func newTestService(t *testing.T, conf string) *Service {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "grpcproxy.conf")
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.ReadConfig(path)
+	if err != nil {
+		t.Fatalf("read config: %s", err)
+	}
+
+	service := NewService()
+	if err := service.Init(cfg); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+
+	t.Cleanup(func() {
+		closeApps(service.Apps())
+	})
+
+	return service
+}
+
+func TestAdminBackends(t *testing.T) {
+	service := newTestService(t, `
+bind = ["127.0.0.1:0"]
+
+app "*" {
+    proxy "foo" {
+        uri = "/rpc.Foo/"
+        backend = "http://127.0.0.1:51001,http://127.0.0.1:51002"
+
+        circuit_breaker {}
+    }
+}
+`)
+
+	rec := httptest.NewRecorder()
+	NewAdmin(service).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/backends", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	var status []proxyStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+
+	if len(status) != 1 || status[0].Proxy != "foo" || len(status[0].Backends) != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	for _, backend := range status[0].Backends {
+		if !backend.Healthy || backend.Ejected || backend.Breaker != "closed" {
+			t.Fatalf("unexpected backend status %+v", backend)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	NewAdmin(service).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/backends", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("post status = %d", rec.Code)
+	}
+}
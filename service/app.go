@@ -6,10 +6,11 @@ import (
 	"net/http"
 
 	"github.com/dtynn/grpcproxy/config"
-	"github.com/gobwas/glob"
 )
 
-func NewApp(service *Service, cfg *config.AppConfig) (*App, error) {
+// NewApp builds the app described by cfg. prev is the app of the same name
+// being replaced by a reload, if any.
+func NewApp(service *Service, cfg *config.AppConfig, prev *App) (*App, error) {
 	app := &App{
 		service: service,
 		cfg:     cfg,
@@ -19,12 +20,13 @@ func NewApp(service *Service, cfg *config.AppConfig) (*App, error) {
 
 	for _, one := range str2NonEmptySlice(host, Sep) {
 		log.Printf("[APP][%s] host pattern %q added", app, one)
-		app.hosts = append(app.hosts, glob.MustCompile(one))
+		app.hosts = append(app.hosts, newPattern(one))
 	}
 
 	for _, proxyCfg := range cfg.Proxy {
-		proxy, err := NewProxy(app, proxyCfg)
+		proxy, err := NewProxy(app, proxyCfg, prev.proxy(proxyCfg.Name))
 		if err != nil {
+			app.Close()
 			return nil, fmt.Errorf("[APP][%s] got proxy init error %q", app, err)
 		}
 
@@ -38,7 +40,7 @@ type App struct {
 	service *Service
 	cfg     *config.AppConfig
 
-	hosts []glob.Glob
+	hosts []pattern
 
 	Proxy []*Proxy
 }
@@ -47,6 +49,27 @@ func (this *App) String() string {
 	return this.cfg.Name
 }
 
+// proxy returns the proxy named name, if this is a non nil app which has one.
+func (this *App) proxy(name string) *Proxy {
+	if this == nil {
+		return nil
+	}
+
+	for _, proxy := range this.Proxy {
+		if proxy.cfg.Name == name {
+			return proxy
+		}
+	}
+
+	return nil
+}
+
+func (this *App) Close() {
+	for _, proxy := range this.Proxy {
+		proxy.Close()
+	}
+}
+
 func (this *App) Match(req *http.Request) (*Proxy, bool) {
 	if !this.matchHost(req) {
 		return nil, false
@@ -0,0 +1,329 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dtynn/grpcproxy/config"
+	"github.com/dtynn/grpcproxy/netutil"
+)
+
+// buildDiscovery sets the proxy up to take its backends from discovery.
+// Its balancer starts empty and gets swapped whenever the discovered
+// backends change.
+func (this *Proxy) buildDiscovery(opt backendOpt) (netutil.Balancer, error) {
+	cfg := this.cfg
+
+	if strings.TrimSpace(cfg.Backend) != "" || len(cfg.Failover) > 0 || len(cfg.Cluster) > 0 || cfg.Sticky != nil {
+		return nil, fmt.Errorf("discovery can't be combined with backend, failover, cluster or sticky")
+	}
+
+	if len(cfg.Discovery) > 1 {
+		return nil, fmt.Errorf("only one discovery allowed")
+	}
+
+	dc := cfg.Discovery[0]
+
+	discovery, err := this.newDiscovery(dc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery %q: %s", dc.Provider, err)
+	}
+
+	this.discovery = discovery
+	this.bopt = opt
+	this.dynamic = netutil.Dynamic()
+
+	return this.dynamic, nil
+}
+
+// newDiscovery builds the provider dc names, reporting to setTargets.
+func (this *Proxy) newDiscovery(dc *config.DiscoveryConfig) (netutil.Discovery, error) {
+	switch dc.Provider {
+	case "dns":
+		opt, err := dnsOpt(dc)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("[PROXY][%s] discover backends from dns %q every %s", this, opt.Name, opt.Interval)
+		return netutil.NewDNSDiscovery(opt, this.setTargets)
+
+	case "file":
+		log.Printf("[PROXY][%s] discover backends from file %q", this, dc.Path)
+		return netutil.NewFileDiscovery(netutil.FileOpt{
+			Path:   strings.TrimSpace(dc.Path),
+			Format: strings.ToLower(strings.TrimSpace(dc.Format)),
+		}, this.setTargets)
+
+	case "consul":
+		opt, err := consulOpt(dc)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("[PROXY][%s] discover backends from consul service %q at %s", this, opt.Service, opt.Address)
+		return netutil.NewConsulDiscovery(opt, this.setTargets)
+
+	case "xds":
+		service := this.app.service
+		if service.xds == nil {
+			return nil, fmt.Errorf("xds not configured on the server")
+		}
+
+		cluster := strings.TrimSpace(dc.Cluster)
+		if cluster == "" {
+			return nil, fmt.Errorf("cluster required")
+		}
+
+		log.Printf("[PROXY][%s] discover backends from xds cluster %q", this, cluster)
+		return netutil.NewXDSDiscovery(service.xds, cluster, service.xdsTimeout, this.setTargets), nil
+
+	case "kubernetes":
+		opt, err := kubeOpt(dc)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := netutil.NewKubeClient(strings.TrimSpace(dc.Kubeconfig))
+		if err != nil {
+			return nil, fmt.Errorf("invalid kubeconfig: %s", err)
+		}
+
+		log.Printf("[PROXY][%s] discover backends from kubernetes service %s/%s", this, opt.Namespace, opt.Service)
+		return netutil.NewKubeDiscovery(client, opt, this.setTargets)
+	}
+
+	return nil, fmt.Errorf("unknown provider, expected dns, file, consul, xds or kubernetes")
+}
+
+// setTargets replaces the backends of the proxy with the healthy targets.
+// Backends still listed are kept along with their health, stats and
+// connections, the others are retired once the new balancer is in place,
+// leaving the requests they serve to finish.
+func (this *Proxy) setTargets(targets []netutil.Target) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return
+	}
+
+	healthy := make([]netutil.Target, 0, len(targets))
+	for _, target := range targets {
+		if !target.Unhealthy {
+			healthy = append(healthy, target)
+		}
+	}
+
+	targets = healthy
+
+	current := backendsByAddr(this.backends)
+
+	// targets come sorted by priority
+	priorities := make([]int, 0)
+	for _, target := range targets {
+		if n := len(priorities); n == 0 || priorities[n-1] != target.Priority {
+			priorities = append(priorities, target.Priority)
+		}
+	}
+
+	tiers := make(map[int][]*netutil.ReverseProxyBackend, len(priorities))
+	backends := make([]*netutil.ReverseProxyBackend, 0, len(targets))
+	added := make([]*netutil.ReverseProxyBackend, 0)
+	kept := make(map[*netutil.ReverseProxyBackend]bool, len(targets))
+
+	// backends replaced here, or by the reload that built the proxy, pass
+	// their warmup on
+	opt := this.bopt
+	opt.prev = make(map[string]*netutil.ReverseProxyBackend, len(this.bopt.prev)+len(current))
+	for addr, backend := range this.bopt.prev {
+		opt.prev[addr] = backend
+	}
+
+	for addr, backend := range current {
+		opt.prev[addr] = backend
+	}
+
+	for _, target := range targets {
+		// a backend keeps its tier for life, one moving to another tier is
+		// replaced
+		group := ""
+		if len(priorities) > 1 {
+			group = tierName(target.Priority)
+		}
+
+		backend, ok := current[target.Addr]
+		if ok && backend.Group() == group {
+			backend.SetWeight(target.Weight)
+			kept[backend] = true
+		} else {
+			url, err := buildTargetUrl(this.cfg.TLS, target.Addr)
+			if err != nil || url == nil {
+				log.Printf("[PROXY][%s] ignore discovered backend %q: %v", this, target.Addr, err)
+				continue
+			}
+
+			backend = this.newBackend(target.Addr, url, target.Weight, opt)
+			added = append(added, backend)
+		}
+
+		tiers[target.Priority] = append(tiers[target.Priority], backend)
+		backends = append(backends, backend)
+	}
+
+	balancer, err := this.buildTargetBalancer(priorities, tiers)
+	if err != nil {
+		log.Printf("[PROXY][%s] keep the previous backends: %s", this, err)
+		return
+	}
+
+	log.Printf("[PROXY][%s] use balancer %q", this, balancer)
+
+	netutil.Attach(balancer, backends)
+	prev := this.dynamic.Current()
+	this.dynamic.Swap(balancer)
+	netutil.Detach(prev, this.backends)
+
+	for _, backend := range this.backends {
+		if kept[backend] {
+			continue
+		}
+
+		backend.Retire()
+
+		if checker, ok := this.checkers[backend]; ok {
+			checker.Close()
+			delete(this.checkers, backend)
+		}
+	}
+
+	if this.healthCheck != nil {
+		for _, backend := range added {
+			this.startChecker(backend)
+		}
+	}
+
+	if this.detector != nil {
+		this.detector.SetBackends(backends)
+	}
+
+	this.backends = backends
+}
+
+// buildTargetBalancer builds a balancer per priority, wrapped into tiers
+// if there are several.
+func (this *Proxy) buildTargetBalancer(priorities []int, tiers map[int][]*netutil.ReverseProxyBackend) (netutil.Balancer, error) {
+	groups := make([]netutil.PriorityGroup, 0, len(priorities))
+	for _, priority := range priorities {
+		backends := tiers[priority]
+
+		balancer, err := newBalancer(this.cfg, backends)
+		if err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, netutil.PriorityGroup{
+			Name:     tierName(priority),
+			Backends: backends,
+			Balancer: balancer,
+		})
+	}
+
+	if len(groups) == 1 {
+		return groups[0].Balancer, nil
+	}
+
+	return netutil.Priority(groups, this.cfg.Overprovisioning)
+}
+
+func tierName(priority int) string {
+	return fmt.Sprintf("priority-%d", priority)
+}
+
+// currentBackends returns the backends the proxy balances across now.
+func (this *Proxy) currentBackends() []*netutil.ReverseProxyBackend {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.backends
+}
+
+func backendsByAddr(backends []*netutil.ReverseProxyBackend) map[string]*netutil.ReverseProxyBackend {
+	m := make(map[string]*netutil.ReverseProxyBackend, len(backends))
+	for _, backend := range backends {
+		m[backend.Addr()] = backend
+	}
+
+	return m
+}
+
+func dnsOpt(cfg *config.DiscoveryConfig) (netutil.DNSOpt, error) {
+	opt := netutil.DNSOpt{
+		Name:   strings.TrimSpace(cfg.Name),
+		Port:   cfg.Port,
+		Server: strings.TrimSpace(cfg.Server),
+	}
+
+	switch strings.ToLower(cfg.Type) {
+	case "", "a", "aaaa":
+
+	case "srv":
+		opt.SRV = true
+
+	default:
+		return opt, fmt.Errorf("unknown type %q, expected a or srv", cfg.Type)
+	}
+
+	var err error
+
+	if opt.Interval, err = config.Duration(cfg.Interval, 30*time.Second); err != nil {
+		return opt, err
+	}
+
+	if opt.Timeout, err = config.Duration(cfg.Timeout, 5*time.Second); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
+}
+
+func consulOpt(cfg *config.DiscoveryConfig) (netutil.ConsulOpt, error) {
+	opt := netutil.ConsulOpt{
+		Address:    strings.TrimSpace(cfg.Address),
+		Service:    strings.TrimSpace(cfg.Service),
+		Tag:        strings.TrimSpace(cfg.Tag),
+		Datacenter: strings.TrimSpace(cfg.Datacenter),
+		Token:      cfg.Token,
+	}
+
+	var err error
+
+	if opt.Wait, err = config.Duration(cfg.Wait, 5*time.Minute); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
+}
+
+func kubeOpt(cfg *config.DiscoveryConfig) (netutil.KubeOpt, error) {
+	opt := netutil.KubeOpt{
+		Service:   strings.TrimSpace(cfg.Service),
+		Namespace: strings.TrimSpace(cfg.Namespace),
+		PortName:  strings.TrimSpace(cfg.PortName),
+		Port:      cfg.Port,
+	}
+
+	var err error
+
+	if opt.Timeout, err = config.Duration(cfg.Timeout, 10*time.Second); err != nil {
+		return opt, err
+	}
+
+	if opt.Resync, err = config.Duration(cfg.Interval, 0); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
+}
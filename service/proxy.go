@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -10,10 +11,11 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dtynn/grpcproxy/config"
 	"github.com/dtynn/grpcproxy/netutil"
-	"github.com/gobwas/glob"
 )
 
 var (
@@ -23,28 +25,56 @@ var (
 	}
 )
 
-func NewProxy(app *App, cfg *config.ProxyConfig) (*Proxy, error) {
+// NewProxy builds the proxy described by cfg. prev is the proxy of the same
+// name being replaced by a reload, if any; backends it shares with cfg keep
+// their slow start progress.
+func NewProxy(app *App, cfg *config.ProxyConfig, prev *Proxy) (_ *Proxy, err error) {
 	proxy := &Proxy{
 		app: app,
 		cfg: cfg,
 	}
 
+	// discovery, mirrors and checkers may be running by the time a later
+	// block turns out invalid
+	defer func() {
+		if err != nil {
+			proxy.Close()
+		}
+	}()
+
 	// host patterns
 	if host := cfg.Host; host != "" {
 		for _, one := range str2NonEmptySlice(host, Sep) {
 			log.Printf("[PROXY][%s] host pattern %q added", proxy, one)
-			proxy.hosts = append(proxy.hosts, glob.MustCompile(one))
+			proxy.hosts = append(proxy.hosts, newPattern(one))
 		}
 	}
 
-	// uri patterns
+	// uri patterns, taken as prefixes unless exact_uri is set
 	for _, one := range str2NonEmptySlice(cfg.URI, Sep) {
-		if !strings.HasSuffix(one, Wildcard) {
+		if !cfg.ExactURI && !strings.HasSuffix(one, Wildcard) {
 			one = one + Wildcard
 		}
 
 		log.Printf("[PROXY][%s] uri pattern %q added", proxy, one)
-		proxy.uris = append(proxy.uris, glob.MustCompile(one))
+		proxy.uris = append(proxy.uris, newPattern(one))
+	}
+
+	// header patterns
+	for _, mc := range cfg.Match {
+		matcher, err := netutil.NewHeaderMatcher(mc.Name, netutil.HeaderMatchOpt{
+			Exact:   mc.Exact,
+			Prefix:  mc.Prefix,
+			Regex:   mc.Regex,
+			Present: mc.Present,
+			Absent:  mc.Absent,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid match: %s", err)
+		}
+
+		log.Printf("[PROXY][%s] header pattern %q added", proxy, matcher)
+		proxy.headers = append(proxy.headers, matcher)
 	}
 
 	// http2 transport
@@ -74,6 +104,15 @@ func NewProxy(app *App, cfg *config.ProxyConfig) (*Proxy, error) {
 		}
 	}
 
+	// deadlines
+	if proxy.defaultTimeout, err = config.Duration(cfg.DefaultTimeout, 0); err != nil {
+		return nil, fmt.Errorf("invalid default_timeout: %s", err)
+	}
+
+	if proxy.maxTimeout, err = config.Duration(cfg.MaxTimeout, 0); err != nil {
+		return nil, fmt.Errorf("invalid max_timeout: %s", err)
+	}
+
 	grpcEnabled := cfg.GetGRPC()
 	log.Printf("[PROXY][%s] grpc enabled %v", proxy, grpcEnabled)
 
@@ -83,9 +122,293 @@ func NewProxy(app *App, cfg *config.ProxyConfig) (*Proxy, error) {
 
 	h2t := netutil.NewTransport(h2topt)
 
+	bopt := backendOpt{
+		transport: h2t,
+	}
+
+	// circuit breaker
+	if cb := cfg.CircuitBreaker; cb != nil {
+		opt, err := breakerOpt(cb)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circuit_breaker: %s", err)
+		}
+
+		bopt.breaker = &opt
+	}
+
+	// slow start
+	if ss := cfg.SlowStart; ss != nil {
+		opt, err := slowStartOpt(ss)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slow_start: %s", err)
+		}
+
+		bopt.slowStart = &opt
+		log.Printf("[PROXY][%s] slow start over %s", proxy, opt.Window)
+	}
+
+	if prev != nil {
+		bopt.prev = backendsByAddr(prev.currentBackends())
+	}
+
 	// reverse proxy backends
+	var (
+		backends []*netutil.ReverseProxyBackend
+		balancer netutil.Balancer
+	)
+
+	switch {
+	case len(cfg.Discovery) > 0:
+		balancer, err = proxy.buildDiscovery(bopt)
+
+	case len(cfg.Cluster) > 0:
+		backends, balancer, err = proxy.buildClusters(bopt)
+
+	default:
+		backends, balancer, err = proxy.buildTiers(bopt)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if split, ok := balancer.(netutil.Splitter); ok {
+		proxy.split = split
+	}
+
+	// sticky sessions
+	if sc := cfg.Sticky; sc != nil {
+		sopt, err := stickyOpt(sc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sticky: %s", err)
+		}
+
+		if balancer, err = netutil.Sticky(balancer, backends, sopt); err != nil {
+			return nil, err
+		}
+
+		if prev != nil {
+			netutil.InheritSessions(balancer, prev.balancer)
+		}
+	}
+
+	log.Printf("[PROXY][%s] use balancer %q", proxy, balancer)
+
+	netutil.Attach(balancer, backends)
+	proxy.balancer = balancer
+	proxy.backends = backends
+
+	// fault injection
+	if fc := cfg.Fault; fc != nil {
+		fopt, err := faultOpt(fc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault: %s", err)
+		}
+
+		proxy.fault = netutil.NewFault(fopt)
+		log.Printf("[PROXY][%s] inject faults %q", proxy, proxy.fault)
+	}
+
+	// traffic mirroring
+	if mc := cfg.Mirror; mc != nil {
+		mopt, err := mirrorOpt(mc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror: %s", err)
+		}
+
+		shadows, err := proxy.buildBackends(mc.Backend, bopt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror: %s", err)
+		}
+
+		shadow, err := newBalancer(cfg, shadows)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror: %s", err)
+		}
+
+		proxy.mirror = netutil.NewMirror(shadow, shadows, mopt)
+		log.Printf("[PROXY][%s] mirror %q", proxy, proxy.mirror)
+	}
+
+	// retry policy
+	if rc := cfg.Retry; rc != nil {
+		ropt, err := retryOpt(rc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry: %s", err)
+		}
+
+		proxy.retry = netutil.NewRetry(ropt)
+		log.Printf("[PROXY][%s] retry up to %d attempts on %v", proxy, ropt.MaxAttempts, ropt.RetryOn)
+	}
+
+	// request hedging
+	if hc := cfg.Hedge; hc != nil {
+		hopt, err := hedgeOpt(hc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hedge: %s", err)
+		}
+
+		proxy.hedge = netutil.NewHedge(hopt)
+		log.Printf("[PROXY][%s] hedge %v after %s, up to %d attempts", proxy, hopt.Methods, hopt.Delay, hopt.MaxAttempts)
+	}
+
+	// active health checks
+	if hc := cfg.HealthCheck; hc != nil {
+		hcopt, err := healthCheckOpt(hc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health_check: %s", err)
+		}
+
+		proxy.healthCheck = &hcopt
+		proxy.checkers = make(map[*netutil.ReverseProxyBackend]*netutil.HealthChecker, len(backends))
+
+		for _, backend := range backends {
+			proxy.startChecker(backend)
+		}
+	}
+
+	// passive outlier detection
+	if od := cfg.OutlierDetection; od != nil {
+		odopt, err := outlierOpt(od)
+		if err != nil {
+			return nil, fmt.Errorf("invalid outlier_detection: %s", err)
+		}
+
+		proxy.detector = netutil.NewOutlierDetector(backends, odopt)
+		log.Printf("[PROXY][%s] outlier detection every %s", proxy, odopt.Interval)
+
+		go proxy.detector.Run()
+	}
+
+	// backend discovery, last as discovered backends get the health checks
+	// and outlier detection set up above
+	if proxy.discovery != nil {
+		proxy.discovery.Refresh()
+		go proxy.discovery.Run()
+	}
+
+	return proxy, nil
+}
+
+// startChecker starts the active health check of backend.
+func (this *Proxy) startChecker(backend *netutil.ReverseProxyBackend) {
+	checker := netutil.NewHealthChecker(backend, *this.healthCheck)
+	log.Printf("[PROXY][%s] health check %q every %s for backend %q", this, this.healthCheck.Service, this.healthCheck.Interval, backend)
+
+	this.checkers[backend] = checker
+	go checker.Run()
+}
+
+// buildTiers builds the proxy's own backends, followed by those of its
+// failover tiers if any.
+func (this *Proxy) buildTiers(opt backendOpt) ([]*netutil.ReverseProxyBackend, netutil.Balancer, error) {
+	cfg := this.cfg
+
+	backends, err := this.buildBackends(cfg.Backend, opt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	balancer, err := newBalancer(cfg, backends)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(cfg.Failover) == 0 {
+		return backends, balancer, nil
+	}
+
+	groups := []netutil.PriorityGroup{{
+		Name:     PrimaryTier,
+		Backends: backends,
+		Balancer: balancer,
+	}}
+
+	for _, fc := range cfg.Failover {
+		tier, err := this.buildBackends(fc.Backend, opt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid failover %q: %s", fc.Name, err)
+		}
+
+		inner, err := newBalancer(cfg, tier)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid failover %q: %s", fc.Name, err)
+		}
+
+		groups = append(groups, netutil.PriorityGroup{
+			Name:     fc.Name,
+			Backends: tier,
+			Balancer: inner,
+		})
+		backends = append(backends, tier...)
+	}
+
+	if balancer, err = netutil.Priority(groups, cfg.Overprovisioning); err != nil {
+		return nil, nil, err
+	}
+
+	return backends, balancer, nil
+}
+
+// buildClusters builds the weighted clusters the proxy splits traffic
+// across.
+func (this *Proxy) buildClusters(opt backendOpt) ([]*netutil.ReverseProxyBackend, netutil.Balancer, error) {
+	cfg := this.cfg
+
+	if strings.TrimSpace(cfg.Backend) != "" || len(cfg.Failover) > 0 {
+		return nil, nil, fmt.Errorf("cluster can't be combined with backend or failover")
+	}
+
+	var key netutil.HashKey
+	if cfg.SplitKey != "" {
+		var err error
+		if key, err = netutil.ParseHashKey(cfg.SplitKey); err != nil {
+			return nil, nil, fmt.Errorf("invalid split_key: %s", err)
+		}
+	}
+
+	backends := make([]*netutil.ReverseProxyBackend, 0)
+	clusters := make([]netutil.SplitCluster, 0, len(cfg.Cluster))
+
+	for _, cc := range cfg.Cluster {
+		cluster, err := this.buildBackends(cc.Backend, opt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid cluster %q: %s", cc.Name, err)
+		}
+
+		balancer, err := newBalancer(cfg, cluster)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid cluster %q: %s", cc.Name, err)
+		}
+
+		clusters = append(clusters, netutil.SplitCluster{
+			Name:     cc.Name,
+			Weight:   cc.Weight,
+			Backends: cluster,
+			Balancer: balancer,
+		})
+		backends = append(backends, cluster...)
+	}
+
+	balancer, err := netutil.Split(clusters, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return backends, balancer, nil
+}
+
+// backendOpt is what every backend of a proxy is set up with.
+type backendOpt struct {
+	transport http.RoundTripper
+	breaker   *netutil.BreakerOpt
+	slowStart *netutil.SlowStartOpt
+	prev      map[string]*netutil.ReverseProxyBackend
+}
+
+func (this *Proxy) buildBackends(spec string, opt backendOpt) ([]*netutil.ReverseProxyBackend, error) {
 	backends := make([]*netutil.ReverseProxyBackend, 0)
-	for _, back := range str2NonEmptySlice(cfg.Backend, Sep) {
+	for _, back := range str2NonEmptySlice(spec, Sep) {
 		weight := 1
 
 		if pieces := str2NonEmptySlice(back, ";"); len(pieces) == 2 {
@@ -95,7 +418,7 @@ func NewProxy(app *App, cfg *config.ProxyConfig) (*Proxy, error) {
 			}
 		}
 
-		target, err := buildTargetUrl(cfg.TLS, back)
+		target, err := buildTargetUrl(this.cfg.TLS, back)
 		if err != nil {
 			return nil, err
 		}
@@ -104,51 +427,340 @@ func NewProxy(app *App, cfg *config.ProxyConfig) (*Proxy, error) {
 			continue
 		}
 
-		backend := netutil.NewReverseProxyBackend(back, target, weight, h2t)
-		log.Printf("[PROXY][%s] backend %q added", proxy, backend)
+		backends = append(backends, this.newBackend(back, target, weight, opt))
+	}
 
-		backends = append(backends, backend)
+	return backends, nil
+}
+
+func (this *Proxy) newBackend(back string, target *url.URL, weight int, opt backendOpt) *netutil.ReverseProxyBackend {
+	backend := netutil.NewReverseProxyBackend(back, target, weight, opt.transport)
+	log.Printf("[PROXY][%s] backend %q added", this, backend)
+
+	if opt.breaker != nil {
+		backend.SetBreaker(netutil.NewBreaker(back, *opt.breaker))
 	}
 
-	var balancer netutil.Balancer
-	var err error
+	if opt.slowStart != nil {
+		backend.SetSlowStart(*opt.slowStart)
+	}
 
-	switch cfg.Policy {
-	case "hash":
-		balancer, err = netutil.Hash(backends)
+	if prev, ok := opt.prev[back]; ok {
+		backend.InheritWarmup(prev)
+	}
 
-	case "round":
-		balancer, err = netutil.RoundRobin(backends)
+	return backend
+}
 
-	case "random":
-		balancer, err = netutil.Random(backends)
+func newBalancer(cfg *config.ProxyConfig, backends []*netutil.ReverseProxyBackend) (netutil.Balancer, error) {
+	policy := cfg.Policy
+	if policy == "" {
+		policy = netutil.DefaultBalancer
+	}
 
-	case "least":
-		balancer, err = netutil.Least(backends)
+	factory, ok := netutil.LookupBalancer(policy)
+	if !ok {
+		return nil, fmt.Errorf("unknown policy %q, expected one of %s", policy, strings.Join(netutil.Balancers(), ", "))
+	}
 
-	default:
-		balancer, err = netutil.RoundRobin(backends)
+	var opts interface{}
+	if factory.Options != nil {
+		opts = factory.Options()
+		if err := cfg.DecodeBalancer(opts); err != nil {
+			return nil, fmt.Errorf("invalid balancer options for policy %q: %s", policy, err)
+		}
 	}
 
+	balancer, err := factory.New(backends, opts)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid balancer for policy %q: %s", policy, err)
 	}
 
-	log.Printf("[PROXY][%s] use balancer %q", proxy, balancer)
+	return balancer, nil
+}
 
-	proxy.balancer = balancer
+func healthCheckOpt(cfg *config.HealthCheckConfig) (netutil.HealthCheckOpt, error) {
+	opt := netutil.HealthCheckOpt{
+		UnhealthyThreshold: cfg.UnhealthyThreshold,
+		HealthyThreshold:   cfg.HealthyThreshold,
+		Service:            cfg.Service,
+	}
 
-	return proxy, nil
+	var err error
+
+	if opt.Interval, err = config.Duration(cfg.Interval, 5*time.Second); err != nil {
+		return opt, err
+	}
+
+	if opt.Timeout, err = config.Duration(cfg.Timeout, time.Second); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
+}
+
+func outlierOpt(cfg *config.OutlierDetectionConfig) (netutil.OutlierOpt, error) {
+	opt := netutil.OutlierOpt{
+		ConsecutiveFailures: cfg.ConsecutiveFailures,
+		FailurePercent:      cfg.FailurePercent,
+		RequestVolume:       cfg.RequestVolume,
+		MaxEjectionPercent:  cfg.MaxEjectionPercent,
+	}
+
+	var err error
+
+	if opt.Interval, err = config.Duration(cfg.Interval, 10*time.Second); err != nil {
+		return opt, err
+	}
+
+	if opt.BaseEjectionTime, err = config.Duration(cfg.BaseEjectionTime, 30*time.Second); err != nil {
+		return opt, err
+	}
+
+	if opt.MaxEjectionTime, err = config.Duration(cfg.MaxEjectionTime, 300*time.Second); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
+}
+
+func breakerOpt(cfg *config.CircuitBreakerConfig) (netutil.BreakerOpt, error) {
+	opt := netutil.BreakerOpt{
+		ErrorPercent:     cfg.ErrorPercent,
+		RequestVolume:    cfg.RequestVolume,
+		MaxRequests:      cfg.MaxRequests,
+		HalfOpenRequests: cfg.HalfOpenRequests,
+	}
+
+	var err error
+
+	if opt.Window, err = config.Duration(cfg.Window, 10*time.Second); err != nil {
+		return opt, err
+	}
+
+	if opt.OpenTimeout, err = config.Duration(cfg.OpenTimeout, 30*time.Second); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
+}
+
+func slowStartOpt(cfg *config.SlowStartConfig) (netutil.SlowStartOpt, error) {
+	opt := netutil.SlowStartOpt{
+		Aggression:       cfg.Aggression,
+		MinWeightPercent: cfg.MinWeightPercent,
+	}
+
+	if cfg.Aggression < 0 {
+		return opt, fmt.Errorf("aggression must be positive")
+	}
+
+	if cfg.MinWeightPercent < 0 || cfg.MinWeightPercent > 100 {
+		return opt, fmt.Errorf("min_weight_percent must be within [0, 100]")
+	}
+
+	var err error
+
+	if opt.Window, err = config.Duration(cfg.Window, 0); err != nil {
+		return opt, err
+	}
+
+	if opt.Window <= 0 {
+		return opt, fmt.Errorf("window required")
+	}
+
+	return opt, nil
+}
+
+func faultOpt(cfg *config.FaultConfig) (netutil.FaultOpt, error) {
+	opt := netutil.FaultOpt{
+		DelayPercent: cfg.DelayPercent,
+		AbortMessage: cfg.AbortMessage,
+		AbortStatus:  cfg.AbortHTTPStatus,
+		AbortPercent: cfg.AbortPercent,
+		Header:       strings.TrimSpace(cfg.Header),
+	}
+
+	if cfg.DelayPercent < 0 || cfg.DelayPercent > 100 || cfg.AbortPercent < 0 || cfg.AbortPercent > 100 {
+		return opt, fmt.Errorf("percents must be within [0, 100]")
+	}
+
+	var err error
+
+	if opt.Delay, err = config.Duration(cfg.Delay, 0); err != nil {
+		return opt, err
+	}
+
+	if cfg.AbortPercent > 0 {
+		if cfg.AbortCode == "" {
+			return opt, fmt.Errorf("abort_code required")
+		}
+
+		if opt.AbortCode, err = netutil.ParseCode(cfg.AbortCode); err != nil {
+			return opt, err
+		}
+	}
+
+	return opt, nil
+}
+
+func mirrorOpt(cfg *config.MirrorConfig) (netutil.MirrorOpt, error) {
+	opt := netutil.MirrorOpt{
+		Percent:       cfg.Percent,
+		Header:        strings.TrimSpace(cfg.Header),
+		MaxBufferSize: cfg.MaxBufferSize,
+		MaxInFlight:   cfg.MaxInFlight,
+	}
+
+	if cfg.Percent <= 0 || cfg.Percent > 100 {
+		return opt, fmt.Errorf("percent must be within (0, 100]")
+	}
+
+	var err error
+
+	if opt.Timeout, err = config.Duration(cfg.Timeout, 5*time.Second); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
+}
+
+func stickyOpt(cfg *config.StickyConfig) (netutil.StickyOpt, error) {
+	opt := netutil.StickyOpt{
+		Key:         strings.TrimSpace(cfg.Key),
+		Header:      strings.TrimSpace(cfg.Header),
+		Cookie:      strings.TrimSpace(cfg.Cookie),
+		MaxSessions: cfg.MaxSessions,
+	}
+
+	var err error
+
+	if opt.TTL, err = config.Duration(cfg.TTL, 30*time.Minute); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
+}
+
+func retryOpt(cfg *config.RetryConfig) (netutil.RetryOpt, error) {
+	opt := netutil.RetryOpt{
+		MaxAttempts:   cfg.MaxAttempts,
+		MaxBufferSize: cfg.MaxBufferSize,
+	}
+
+	for _, name := range cfg.RetryOn {
+		code, err := netutil.ParseCode(name)
+		if err != nil {
+			return opt, err
+		}
+
+		opt.RetryOn = append(opt.RetryOn, code)
+	}
+
+	var err error
+
+	if opt.BackoffBase, err = config.Duration(cfg.BackoffBase, 25*time.Millisecond); err != nil {
+		return opt, err
+	}
+
+	if opt.BackoffMax, err = config.Duration(cfg.BackoffMax, 250*time.Millisecond); err != nil {
+		return opt, err
+	}
+
+	if opt.PerTryTimeout, err = config.Duration(cfg.PerTryTimeout, 0); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
+}
+
+func hedgeOpt(cfg *config.HedgeConfig) (netutil.HedgeOpt, error) {
+	opt := netutil.HedgeOpt{
+		Methods:       cfg.Methods,
+		MaxAttempts:   cfg.MaxAttempts,
+		MaxBufferSize: cfg.MaxBufferSize,
+	}
+
+	if len(opt.Methods) == 0 {
+		return opt, fmt.Errorf("methods required")
+	}
+
+	for _, name := range cfg.NonFatal {
+		code, err := netutil.ParseCode(name)
+		if err != nil {
+			return opt, err
+		}
+
+		opt.NonFatal = append(opt.NonFatal, code)
+	}
+
+	var err error
+
+	if opt.Delay, err = config.Duration(cfg.Delay, 50*time.Millisecond); err != nil {
+		return opt, err
+	}
+
+	return opt, nil
 }
 
 type Proxy struct {
 	app *App
 	cfg *config.ProxyConfig
 
-	hosts []glob.Glob
-	uris  []glob.Glob
+	hosts   []pattern
+	uris    []pattern
+	headers []*netutil.HeaderMatcher
+
+	defaultTimeout time.Duration
+	maxTimeout     time.Duration
+
+	// mu guards backends and checkers, which change with discovery
+	mu     sync.Mutex
+	closed bool
+
+	backends    []*netutil.ReverseProxyBackend
+	balancer    netutil.Balancer
+	split       netutil.Splitter
+	mirror      *netutil.Mirror
+	fault       *netutil.Fault
+	retry       *netutil.Retry
+	hedge       *netutil.Hedge
+	healthCheck *netutil.HealthCheckOpt
+	checkers    map[*netutil.ReverseProxyBackend]*netutil.HealthChecker
+	detector    *netutil.OutlierDetector
+
+	dynamic   *netutil.DynamicBalancer
+	discovery netutil.Discovery
+	bopt      backendOpt
+}
+
+// Close stops the background work started for the proxy.
+func (this *Proxy) Close() {
+	if this.discovery != nil {
+		this.discovery.Close()
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.closed = true
+
+	netutil.Detach(this.balancer, this.backends)
+	if this.dynamic != nil {
+		netutil.Detach(this.dynamic.Current(), this.backends)
+	}
+
+	if this.mirror != nil {
+		this.mirror.Close()
+	}
+
+	for _, checker := range this.checkers {
+		checker.Close()
+	}
 
-	balancer netutil.Balancer
+	if this.detector != nil {
+		this.detector.Close()
+	}
 }
 
 func (this *Proxy) Match(req *http.Request) bool {
@@ -156,7 +768,7 @@ func (this *Proxy) Match(req *http.Request) bool {
 		return false
 	}
 
-	return this.matchURI(req)
+	return this.matchURI(req) && this.matchHeaders(req)
 }
 
 func (this *Proxy) matchHost(req *http.Request) bool {
@@ -173,6 +785,16 @@ func (this *Proxy) matchHost(req *http.Request) bool {
 	return false
 }
 
+func (this *Proxy) matchHeaders(req *http.Request) bool {
+	for _, matcher := range this.headers {
+		if !matcher.Match(req) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (this *Proxy) matchURI(req *http.Request) bool {
 	for _, pattern := range this.uris {
 		if pattern.Match(req.RequestURI) {
@@ -184,10 +806,63 @@ func (this *Proxy) matchURI(req *http.Request) bool {
 }
 
 func (this *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if timeout, ok := this.timeout(req); ok {
+		if timeout <= 0 {
+			netutil.WriteContextError(rw, req, context.DeadlineExceeded)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+
+		req = req.WithContext(ctx)
+	}
+
+	if this.fault != nil && this.fault.Inject(rw, req) {
+		return
+	}
+
+	if this.mirror != nil {
+		var shadow func()
+		if req, shadow = this.mirror.Tee(req); shadow != nil {
+			defer shadow()
+		}
+	}
+
+	if this.hedge != nil && this.hedge.Match(req) {
+		this.hedge.Serve(this.balancer, rw, req)
+		return
+	}
+
+	if this.retry != nil {
+		this.retry.Serve(this.balancer, rw, req)
+		return
+	}
+
 	h := this.balancer.Pick(req)
 	h.ServeHTTP(rw, req)
 }
 
+// timeout returns the deadline budget of the request: the caller's
+// grpc-timeout or the proxy default, clamped to the proxy maximum.
+func (this *Proxy) timeout(req *http.Request) (time.Duration, bool) {
+	timeout, ok := this.defaultTimeout, this.defaultTimeout > 0
+
+	if value := req.Header.Get(netutil.GRPCTimeoutHeader); value != "" {
+		if d, err := netutil.ParseGRPCTimeout(value); err != nil {
+			log.Printf("[PROXY][%s] ignore %s", this, err)
+		} else {
+			timeout, ok = d, true
+		}
+	}
+
+	if this.maxTimeout > 0 && (!ok || timeout > this.maxTimeout) {
+		timeout, ok = this.maxTimeout, true
+	}
+
+	return timeout, ok
+}
+
 func (this *Proxy) String() string {
 	return fmt.Sprintf("%s-%s", this.app, this.cfg.Name)
 }
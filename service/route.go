@@ -0,0 +1,291 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+const globMeta = "*?[]{}\\!"
+
+// pattern is a compiled host or uri glob along with its source.
+type pattern struct {
+	glob.Glob
+	src string
+}
+
+func newPattern(src string) pattern {
+	return pattern{
+		Glob: glob.MustCompile(src),
+		src:  src,
+	}
+}
+
+// exact reports whether the pattern matches its source only.
+func (this pattern) exact() bool {
+	return !strings.ContainsAny(this.src, globMeta)
+}
+
+// literals counts the characters the pattern matches literally.
+func (this pattern) literals() int {
+	n := 0
+	for _, c := range this.src {
+		if !strings.ContainsRune(globMeta, c) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// prefix returns the literal part of the pattern before its first
+// wildcard, and whether the rest is a single trailing "*".
+func (this pattern) prefix() (string, bool) {
+	i := strings.IndexAny(this.src, globMeta)
+	if i < 0 {
+		return this.src, false
+	}
+
+	return this.src[:i], this.src[i:] == Wildcard
+}
+
+// moreSpecific compares host patterns: exact hosts before globs, then
+// globs with more literal characters first. A nil pattern matches any
+// host and comes last.
+func moreSpecific(a, b *pattern) (bool, bool) {
+	switch {
+	case a == nil && b == nil:
+		return false, false
+
+	case b == nil:
+		return true, true
+
+	case a == nil:
+		return false, true
+
+	case a.exact() != b.exact():
+		return a.exact(), true
+
+	case a.literals() != b.literals():
+		return a.literals() > b.literals(), true
+	}
+
+	return false, false
+}
+
+// route is one host / uri combination of a proxy. Every proxy contributes
+// a route for each of its uri patterns and each pair of app and proxy
+// host patterns.
+type route struct {
+	app   *App
+	proxy *Proxy
+
+	appHost   *pattern
+	proxyHost *pattern
+	uri       pattern
+
+	order int
+}
+
+func (this *route) Match(req *http.Request) bool {
+	if this.appHost != nil && !this.appHost.Match(req.Host) {
+		return false
+	}
+
+	if this.proxyHost != nil && !this.proxyHost.Match(req.Host) {
+		return false
+	}
+
+	return this.uri.Match(req.RequestURI) && this.proxy.matchHeaders(req)
+}
+
+// host is the more specific of the app and proxy host patterns.
+func (this *route) host() *pattern {
+	if more, _ := moreSpecific(this.proxyHost, this.appHost); more {
+		return this.proxyHost
+	}
+
+	return this.appHost
+}
+
+func (this *route) String() string {
+	host := "*"
+	if h := this.host(); h != nil {
+		host = h.src
+	}
+
+	s := fmt.Sprintf("app %q proxy %q: %s%s", this.app, this.proxy.cfg.Name, host, this.uri.src)
+	for _, matcher := range this.proxy.headers {
+		s += fmt.Sprintf(" [%s]", matcher)
+	}
+
+	return s
+}
+
+// before orders routes: higher app priority, then higher proxy priority,
+// then the more specific host, the longer uri and the more header matches,
+// and finally declaration order.
+func (this *route) before(other *route) bool {
+	if a, b := this.app.cfg.Priority, other.app.cfg.Priority; a != b {
+		return a > b
+	}
+
+	if a, b := this.proxy.cfg.Priority, other.proxy.cfg.Priority; a != b {
+		return a > b
+	}
+
+	if more, ok := moreSpecific(this.host(), other.host()); ok {
+		return more
+	}
+
+	if a, b := this.uri.literals(), other.uri.literals(); a != b {
+		return a > b
+	}
+
+	if a, b := len(this.proxy.headers), len(other.proxy.headers); a != b {
+		return a > b
+	}
+
+	return this.order < other.order
+}
+
+// covers reports whether every request matching other also matches this.
+// It only recognizes the common cases: hosts which are equal or match
+// anything, uri patterns made of a literal prefix and a trailing "*",
+// and header matches this route shares with other.
+func (this *route) covers(other *route) bool {
+	if !coversHost(this.appHost, other) || !coversHost(this.proxyHost, other) {
+		return false
+	}
+
+	prefix, simple := this.uri.prefix()
+	if !simple && this.uri.src != other.uri.src {
+		return false
+	}
+
+	if simple {
+		otherPrefix, _ := other.uri.prefix()
+		if !strings.HasPrefix(otherPrefix, prefix) {
+			return false
+		}
+	}
+
+	for _, matcher := range this.proxy.headers {
+		shared := false
+		for _, one := range other.proxy.headers {
+			if one.String() == matcher.String() {
+				shared = true
+				break
+			}
+		}
+
+		if !shared {
+			return false
+		}
+	}
+
+	return true
+}
+
+func coversHost(host *pattern, other *route) bool {
+	if host == nil || host.src == Wildcard {
+		return true
+	}
+
+	for _, one := range []*pattern{other.appHost, other.proxyHost} {
+		if one != nil && one.src == host.src {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildRoutes flattens the proxies of apps into routes, in match order,
+// and logs routes which can never match because an earlier route takes
+// all their requests.
+func buildRoutes(apps []*App) []*route {
+	routes := make([]*route, 0)
+
+	for _, app := range apps {
+		appHosts := make([]*pattern, 0, len(app.hosts))
+		for i := range app.hosts {
+			appHosts = append(appHosts, &app.hosts[i])
+		}
+
+		if len(appHosts) == 0 {
+			appHosts = append(appHosts, nil)
+		}
+
+		for _, proxy := range app.Proxy {
+			proxyHosts := make([]*pattern, 0, len(proxy.hosts))
+			for i := range proxy.hosts {
+				proxyHosts = append(proxyHosts, &proxy.hosts[i])
+			}
+
+			if len(proxyHosts) == 0 {
+				proxyHosts = append(proxyHosts, nil)
+			}
+
+			for _, appHost := range appHosts {
+				for _, proxyHost := range proxyHosts {
+					for _, uri := range proxy.uris {
+						routes = append(routes, &route{
+							app:       app,
+							proxy:     proxy,
+							appHost:   appHost,
+							proxyHost: proxyHost,
+							uri:       uri,
+							order:     len(routes),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].before(routes[j])
+	})
+
+	for i, one := range routes {
+		log.Printf("[ROUTE] #%d %s", i, one)
+	}
+
+	for _, conflict := range routeConflicts(routes) {
+		log.Printf("[ROUTE] %s", conflict)
+	}
+
+	return routes
+}
+
+// routeConflicts describes the routes, in match order, which can never
+// match because an earlier route takes all their requests.
+func routeConflicts(routes []*route) []string {
+	conflicts := make([]string, 0)
+
+	for i, one := range routes {
+		for _, earlier := range routes[:i] {
+			if earlier.proxy == one.proxy || !earlier.covers(one) {
+				continue
+			}
+
+			// the same requests at the same priorities, only declaration
+			// order tells them apart
+			samePriority := earlier.app.cfg.Priority == one.app.cfg.Priority && earlier.proxy.cfg.Priority == one.proxy.cfg.Priority
+			if samePriority && one.covers(earlier) {
+				conflicts = append(conflicts, fmt.Sprintf("conflict: %s and %s match the same requests, the former wins by declaration order", earlier, one))
+			} else {
+				conflicts = append(conflicts, fmt.Sprintf("shadowed: %s never matches, %s takes its requests", one, earlier))
+			}
+
+			break
+		}
+	}
+
+	return conflicts
+}
@@ -0,0 +1,277 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// routeFor returns the name of the proxy the service routes req to.
+func routeFor(service *Service, req *http.Request) string {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+
+	for _, route := range service.routes {
+		if route.Match(req) {
+			return route.proxy.cfg.Name
+		}
+	}
+
+	return ""
+}
+
+func TestExactURI(t *testing.T) {
+	service := newTestService(t, `
+bind = ["127.0.0.1:0"]
+
+app "*" {
+    proxy "method" {
+        uri = "/pkg.Svc/Method"
+        exact_uri = true
+        backend = "http://127.0.0.1:51001"
+    }
+
+    proxy "service" {
+        uri = "/pkg.Svc/"
+        backend = "http://127.0.0.1:51002"
+    }
+}
+`)
+
+	for uri, want := range map[string]string{
+		"/pkg.Svc/Method":      "method",
+		"/pkg.Svc/MethodX":     "service",
+		"/pkg.Svc/Method/more": "service",
+		"/pkg.Svc/Other":       "service",
+		"/pkg.Other/Method":    "",
+	} {
+		req := httptest.NewRequest(http.MethodPost, uri, nil)
+		if got := routeFor(service, req); got != want {
+			t.Errorf("%s routed to %q, want %q", uri, got, want)
+		}
+	}
+}
+
+type routeCase struct {
+	host    string
+	uri     string
+	headers map[string]string
+	want    string
+}
+
+func TestRouteOrder(t *testing.T) {
+	for name, tc := range map[string]struct {
+		conf  string
+		cases []routeCase
+	}{
+		"priority": {
+			conf: `
+app "api" {
+    host = "api.example.com"
+
+    proxy "api" {
+        uri = "/pkg.Svc/"
+        backend = "http://127.0.0.1:51001"
+    }
+}
+
+app "all" {
+    host = "*"
+    priority = 1
+
+    proxy "all" {
+        uri = "/pkg.Svc/Method"
+        backend = "http://127.0.0.1:51002"
+    }
+}
+`,
+			cases: []routeCase{
+				{host: "api.example.com", uri: "/pkg.Svc/Method", want: "all"},
+				{host: "api.example.com", uri: "/pkg.Svc/Other", want: "api"},
+				{host: "www.example.com", uri: "/pkg.Svc/Method", want: "all"},
+			},
+		},
+		"exact host before glob": {
+			conf: `
+app "*" {
+    proxy "glob" {
+        uri = "/pkg.Svc/"
+        host = "*.example.com"
+        backend = "http://127.0.0.1:51001"
+    }
+
+    proxy "exact" {
+        uri = "/pkg.Svc/"
+        host = "api.example.com"
+        backend = "http://127.0.0.1:51002"
+    }
+}
+`,
+			cases: []routeCase{
+				{host: "api.example.com", uri: "/pkg.Svc/Method", want: "exact"},
+				{host: "www.example.com", uri: "/pkg.Svc/Method", want: "glob"},
+				{host: "example.org", uri: "/pkg.Svc/Method", want: ""},
+			},
+		},
+		"longer uri first": {
+			conf: `
+app "*" {
+    proxy "service" {
+        uri = "/pkg.Svc/"
+        backend = "http://127.0.0.1:51001"
+    }
+
+    proxy "method" {
+        uri = "/pkg.Svc/Method"
+        backend = "http://127.0.0.1:51002"
+    }
+}
+`,
+			cases: []routeCase{
+				{uri: "/pkg.Svc/Method", want: "method"},
+				{uri: "/pkg.Svc/Other", want: "service"},
+			},
+		},
+		"header matches before the catch-all": {
+			conf: `
+app "*" {
+    proxy "stable" {
+        uri = "/pkg.Svc/"
+        backend = "http://127.0.0.1:51001"
+    }
+
+    proxy "canary" {
+        uri = "/pkg.Svc/"
+        backend = "http://127.0.0.1:51002"
+
+        match "x-env" {
+            exact = "canary"
+        }
+    }
+}
+`,
+			cases: []routeCase{
+				{uri: "/pkg.Svc/Method", headers: map[string]string{"x-env": "canary"}, want: "canary"},
+				{uri: "/pkg.Svc/Method", headers: map[string]string{"x-env": "prod"}, want: "stable"},
+				{uri: "/pkg.Svc/Method", want: "stable"},
+			},
+		},
+		"two wildcard apps": {
+			conf: `
+app "*" {
+    proxy "foo.canary" {
+        uri = "/rpc.Foo/"
+        backend = "http://127.0.0.1:51002"
+
+        match "x-env" {
+            exact = "canary"
+        }
+    }
+
+    proxy "/rpc.Foo/" {
+        backend = "http://127.0.0.1:51001"
+    }
+}
+
+app "*" {
+    proxy "/rpc.Bar/" {
+        host = "local.ezbuy.sg"
+        backend = "http://127.0.0.1:51004"
+    }
+}
+
+app "rpc.Bar" {
+    host = "localhost"
+
+    proxy "bar.backend" {
+        uri = "/rpc.Bar/"
+        backend = "http://127.0.0.1:51003"
+    }
+}
+`,
+			cases: []routeCase{
+				{uri: "/rpc.Foo/Hello", want: "/rpc.Foo/"},
+				{uri: "/rpc.Foo/Hello", headers: map[string]string{"x-env": "canary"}, want: "foo.canary"},
+				{host: "local.ezbuy.sg", uri: "/rpc.Bar/Hello", want: "/rpc.Bar/"},
+				{host: "localhost", uri: "/rpc.Bar/Hello", want: "bar.backend"},
+				{host: "example.com", uri: "/rpc.Bar/Hello", want: ""},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service := newTestService(t, "bind = [\"127.0.0.1:0\"]\n"+tc.conf)
+
+			for _, one := range tc.cases {
+				req := httptest.NewRequest(http.MethodPost, one.uri, nil)
+				if one.host != "" {
+					req.Host = one.host
+				}
+
+				for key, value := range one.headers {
+					req.Header.Set(key, value)
+				}
+
+				if got := routeFor(service, req); got != one.want {
+					t.Errorf("%s%s %v routed to %q, want %q", req.Host, one.uri, one.headers, got, one.want)
+				}
+			}
+
+			service.mu.RLock()
+			conflicts := routeConflicts(service.routes)
+			service.mu.RUnlock()
+
+			if len(conflicts) != 0 {
+				t.Errorf("unexpected conflicts: %v", conflicts)
+			}
+		})
+	}
+}
+
+func TestRouteConflicts(t *testing.T) {
+	service := newTestService(t, `
+bind = ["127.0.0.1:0"]
+
+app "*" {
+    proxy "service" {
+        uri = "/pkg.Svc/"
+        priority = 1
+        backend = "http://127.0.0.1:51001"
+    }
+
+    proxy "method" {
+        uri = "/pkg.Svc/Method"
+        backend = "http://127.0.0.1:51002"
+    }
+
+    proxy "first" {
+        uri = "/pkg.Other/"
+        backend = "http://127.0.0.1:51003"
+    }
+
+    proxy "second" {
+        uri = "/pkg.Other/"
+        backend = "http://127.0.0.1:51004"
+    }
+}
+`)
+
+	// the proxy priority puts the service before the longer uri
+	req := httptest.NewRequest(http.MethodPost, "/pkg.Svc/Method", nil)
+	if got := routeFor(service, req); got != "service" {
+		t.Errorf("/pkg.Svc/Method routed to %q, want %q", got, "service")
+	}
+
+	service.mu.RLock()
+	conflicts := routeConflicts(service.routes)
+	service.mu.RUnlock()
+
+	want := []string{
+		`shadowed: app "*" proxy "method": */pkg.Svc/Method* never matches, app "*" proxy "service": */pkg.Svc/* takes its requests`,
+		`conflict: app "*" proxy "first": */pkg.Other/* and app "*" proxy "second": */pkg.Other/* match the same requests, the former wins by declaration order`,
+	}
+
+	if strings.Join(conflicts, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got conflicts\n%s\nwant\n%s", strings.Join(conflicts, "\n"), strings.Join(want, "\n"))
+	}
+}
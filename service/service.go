@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/dtynn/grpcproxy/config"
 	"github.com/dtynn/grpcproxy/netutil"
+	"google.golang.org/grpc/codes"
 )
 
 func NewServiceWithCfgFile(cfgFilePath string) (*Service, error) {
@@ -39,8 +42,15 @@ type Service struct {
 
 	cfg config.ServerConfig
 
-	apps []*App
-	svrs []*netutil.Server
+	apps   []*App
+	routes []*route
+	svrs   []*netutil.Server
+	admin  *http.Server
+
+	// xdsApps are built from the routes of the control plane
+	xds        *netutil.XDSClient
+	xdsTimeout time.Duration
+	xdsApps    []*App
 
 	closeCh chan struct{}
 	mu      sync.RWMutex
@@ -54,23 +64,33 @@ func (this *Service) Init(cfg config.ServerConfig) error {
 		return fmt.Errorf("[SERVER] already initialized")
 	}
 
-	apps, err := this.buildApps(&cfg)
-	if err != nil {
+	this.cfg = cfg
+
+	if err := this.initXDS(cfg.XDS); err != nil {
 		return err
 	}
 
-	this.apps = apps
+	apps, err := this.buildApps(&cfg, nil)
+	if err != nil {
+		this.abortInit(nil)
+		return err
+	}
 
 	cert, err := loadCerts(cfg.Cert)
 	if err != nil {
+		this.abortInit(apps)
 		return err
 	}
 
 	bindings := nonEmptySlice(cfg.Bind)
 	if len(bindings) == 0 {
+		this.abortInit(apps)
 		return fmt.Errorf("[SERVER] bindings required")
 	}
 
+	this.apps = apps
+	this.routes = buildRoutes(this.allApps())
+
 	log.Printf("[SERVER] bind on %v", bindings)
 
 	svrs := make([]*netutil.Server, 0, len(bindings))
@@ -88,10 +108,35 @@ func (this *Service) Init(cfg config.ServerConfig) error {
 	}
 
 	this.svrs = svrs
+
+	if cfg.Admin != "" {
+		log.Printf("[SERVER] admin api on %s", cfg.Admin)
+		this.admin = &http.Server{
+			Addr:    cfg.Admin,
+			Handler: NewAdmin(this),
+		}
+	}
+
+	// the xds apps are built once nothing can fail anymore
+	if this.xds != nil && len(nonEmptySlice(cfg.XDS.RouteConfig)) > 0 {
+		go this.watchXDS()
+	}
+
 	this.initialized = true
 	return nil
 }
 
+// abortInit closes the apps and the xds client of a failed Init, so that
+// their goroutines stop. It must be called with mu held.
+func (this *Service) abortInit(apps []*App) {
+	closeApps(apps)
+
+	if this.xds != nil {
+		this.xds.Close()
+		this.xds = nil
+	}
+}
+
 func (this *Service) ReloadConfigFile() error {
 	cfg, err := config.ReadConfig(this.cfgFilePath)
 	if err != nil {
@@ -103,16 +148,30 @@ func (this *Service) ReloadConfigFile() error {
 
 func (this *Service) Reload(cfg config.ServerConfig) error {
 	log.Printf("[SERVER] reloading")
+
+	this.mu.RLock()
+	prev := this.apps
+	if !reflect.DeepEqual(cfg.XDS, this.cfg.XDS) {
+		log.Printf("[SERVER] xds changes take a restart")
+	}
+	this.mu.RUnlock()
+
 	// init apps
-	apps, err := this.buildApps(&cfg)
+	apps, err := this.buildApps(&cfg, prev)
 	if err != nil {
 		return err
 	}
 
 	this.mu.Lock()
+	old := this.apps
+	cfg.XDS = this.cfg.XDS
+	this.cfg = cfg
 	this.apps = apps
+	this.routes = buildRoutes(this.allApps())
 	this.mu.Unlock()
 
+	closeApps(old)
+
 	return nil
 }
 
@@ -128,7 +187,7 @@ func (this *Service) Run() error {
 	servers := this.svrs
 
 	var wg sync.WaitGroup
-	errCh := make(chan error, len(servers))
+	errCh := make(chan error, len(servers)+1)
 
 	for _, server := range servers {
 		wg.Add(1)
@@ -141,6 +200,17 @@ func (this *Service) Run() error {
 		}(server, &wg, errCh)
 	}
 
+	if admin := this.admin; admin != nil {
+		wg.Add(1)
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				errCh <- err
+			}
+
+			wg.Done()
+		}()
+	}
+
 	var err error
 
 	select {
@@ -154,8 +224,22 @@ func (this *Service) Run() error {
 		server.Close()
 	}
 
+	if this.admin != nil {
+		this.admin.Close()
+	}
+
 	wg.Wait()
 
+	if this.xds != nil {
+		this.xds.Close()
+	}
+
+	this.mu.RLock()
+	apps := this.allApps()
+	this.mu.RUnlock()
+
+	closeApps(apps)
+
 	return err
 }
 
@@ -163,12 +247,54 @@ func (this *Service) Close() {
 	close(this.closeCh)
 }
 
-func (this *Service) buildApps(cfg *config.ServerConfig) ([]*App, error) {
+// Apps returns the apps currently serving requests.
+func (this *Service) Apps() []*App {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.allApps()
+}
+
+// allApps returns the apps of the config file followed by those of the
+// control plane. It must be called with mu held.
+func (this *Service) allApps() []*App {
+	apps := make([]*App, 0, len(this.apps)+len(this.xdsApps))
+	apps = append(apps, this.apps...)
+	return append(apps, this.xdsApps...)
+}
+
+// findProxy returns the first proxy named proxyName in an app named appName.
+func (this *Service) findProxy(appName, proxyName string) *Proxy {
+	for _, app := range this.Apps() {
+		if app.cfg.Name != appName {
+			continue
+		}
+
+		if proxy := app.proxy(proxyName); proxy != nil {
+			return proxy
+		}
+	}
+
+	return nil
+}
+
+// buildApps builds the apps of cfg, matching them by name against prev,
+// the apps being replaced.
+func (this *Service) buildApps(cfg *config.ServerConfig, prev []*App) ([]*App, error) {
 	apps := make([]*App, 0, len(cfg.App))
 
 	for _, appCfg := range cfg.App {
-		app, err := NewApp(this, appCfg)
+		var prevApp *App
+		for _, one := range prev {
+			if one.cfg.Name == appCfg.Name {
+				prevApp = one
+				break
+			}
+		}
+
+		app, err := NewApp(this, appCfg, prevApp)
 		if err != nil {
+			closeApps(apps)
 			return nil, err
 		}
 
@@ -180,17 +306,24 @@ func (this *Service) buildApps(cfg *config.ServerConfig) ([]*App, error) {
 
 func (this *Service) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	this.mu.RLock()
-	apps := this.apps
+	routes := this.routes
 	this.mu.RUnlock()
 
-	for _, app := range apps {
-		if proxy, ok := app.Match(req); ok {
-			proxy.ServeHTTP(rw, req)
+	for _, route := range routes {
+		if route.Match(req) {
+			route.proxy.ServeHTTP(rw, req)
 			return
 		}
 	}
 
 	log.Printf("[NOT FOUND][%s] %s%s", req.Method, req.Host, req.RequestURI)
+	netutil.WriteError(rw, req, http.StatusNotFound, codes.Unimplemented, fmt.Sprintf("no route for %s%s", req.Host, req.URL.Path))
+}
+
+func closeApps(apps []*App) {
+	for _, app := range apps {
+		app.Close()
+	}
 }
 
 func loadCerts(path []string) ([]tls.Certificate, error) {
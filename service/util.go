@@ -17,6 +17,7 @@ const (
 	Wildcard    = config.Wildcard
 	HTTPSPrefix = "https://"
 	HTTPPrefix  = "http://"
+	PrimaryTier = "primary"
 )
 
 func str2NonEmptySlice(s, sep string) []string {
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dtynn/grpcproxy/config"
+	"github.com/dtynn/grpcproxy/netutil"
+	"github.com/gobwas/glob"
+)
+
+// initXDS connects to the control plane of cfg, if any.
+func (this *Service) initXDS(cfg *config.XDSConfig) error {
+	if cfg == nil {
+		return nil
+	}
+
+	opt := netutil.XDSOpt{
+		Address:      strings.TrimSpace(cfg.Address),
+		TLS:          cfg.TLS,
+		NodeID:       strings.TrimSpace(cfg.NodeID),
+		NodeCluster:  strings.TrimSpace(cfg.NodeCluster),
+		RouteConfigs: nonEmptySlice(cfg.RouteConfig),
+	}
+
+	timeout, err := config.Duration(cfg.Timeout, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("[SERVER] invalid xds: %s", err)
+	}
+
+	client, err := netutil.NewXDSClient(opt)
+	if err != nil {
+		return fmt.Errorf("[SERVER] invalid xds: %s", err)
+	}
+
+	log.Printf("[SERVER] xds %q, route configurations %v", client, opt.RouteConfigs)
+
+	this.xds = client
+	this.xdsTimeout = timeout
+
+	go client.Run()
+
+	return nil
+}
+
+// watchXDS rebuilds the apps served from the route configurations of the
+// control plane whenever its routes or clusters change.
+func (this *Service) watchXDS() {
+	var last []byte
+
+	for {
+		select {
+		case <-this.closeCh:
+			return
+
+		case <-this.xds.Changed():
+		}
+
+		this.mu.RLock()
+		cfg := xdsServerConfig(&this.cfg, this.xds)
+		prev := this.xdsApps
+		this.mu.RUnlock()
+
+		// clusters change far more often than what apps are built from
+		current, err := json.Marshal(cfg)
+		if err == nil && string(current) == string(last) {
+			continue
+		}
+
+		apps, err := this.buildApps(&cfg, prev)
+		if err != nil {
+			log.Printf("[SERVER] keep the xds apps: %s", err)
+			continue
+		}
+
+		last = current
+
+		this.mu.Lock()
+		old := this.xdsApps
+		this.xdsApps = apps
+		this.routes = buildRoutes(this.allApps())
+		this.mu.Unlock()
+
+		closeApps(old)
+	}
+}
+
+// xdsServerConfig describes the virtual hosts of client as apps, which
+// inherit the grpc and ca settings of base. The apps rank below those
+// without a priority, the more specific their domains the higher, and the
+// proxies of an app in the order of its routes.
+func xdsServerConfig(base *config.ServerConfig, client *netutil.XDSClient) config.ServerConfig {
+	cfg := config.ServerConfig{
+		GRPC: base.GRPC,
+		CA:   base.CA,
+	}
+
+	vhosts := client.Routes()
+	for i := range vhosts {
+		vhosts[i].Domains = validDomains(vhosts[i])
+	}
+
+	sort.SliceStable(vhosts, func(i, j int) bool {
+		more, _ := moreSpecific(mostSpecificDomain(vhosts[i].Domains), mostSpecificDomain(vhosts[j].Domains))
+		return more
+	})
+
+	for rank, vhost := range vhosts {
+		if len(vhost.Domains) == 0 {
+			continue
+		}
+
+		app := &config.AppConfig{
+			Host:     strings.Join(vhost.Domains, Sep),
+			Priority: -1 - rank,
+		}
+
+		used := make(map[string]bool, len(vhost.Routes))
+
+		for i, route := range vhost.Routes {
+			name := route.Name
+			if name == "" || used[name] {
+				name = fmt.Sprintf("route-%d", i)
+			}
+
+			used[name] = true
+
+			// xds matches paths literally, path routes as a whole
+			uri := glob.QuoteMeta(route.Prefix)
+			if route.Path != "" {
+				uri = glob.QuoteMeta(route.Path)
+			}
+
+			if uri == "" {
+				uri = "/"
+			}
+
+			proxy := &config.ProxyConfig{
+				URI:      uri,
+				ExactURI: route.Path != "",
+
+				// routes are tried in order
+				Priority: len(vhost.Routes) - i,
+
+				DiscoveryM: []map[string]*config.DiscoveryConfig{{
+					"xds": {
+						Cluster: route.Cluster,
+					},
+				}},
+			}
+
+			if route.Timeout > 0 {
+				proxy.DefaultTimeout = route.Timeout.String()
+			}
+
+			if cluster, ok := client.Cluster(route.Cluster); ok {
+				proxy.Policy = cluster.Policy
+				proxy.TLS = cluster.TLS
+			}
+
+			for _, header := range route.Headers {
+				proxy.MatchM = append(proxy.MatchM, map[string]*config.HeaderMatchConfig{
+					header.Name: {
+						Exact:   header.Exact,
+						Prefix:  header.Prefix,
+						Regex:   header.Regex,
+						Present: header.Present,
+						Absent:  header.Absent,
+					},
+				})
+			}
+
+			app.ProxyM = append(app.ProxyM, map[string]*config.ProxyConfig{
+				name: proxy,
+			})
+		}
+
+		cfg.AppM = append(cfg.AppM, map[string]*config.AppConfig{
+			vhost.Name: app,
+		})
+	}
+
+	cfg.Init()
+
+	return cfg
+}
+
+// validDomains returns the domains of vhost which compile as host
+// patterns, the control plane isn't trusted to send only those.
+func validDomains(vhost netutil.XDSVirtualHost) []string {
+	domains := make([]string, 0, len(vhost.Domains))
+	for _, domain := range vhost.Domains {
+		if _, err := glob.Compile(domain); err != nil {
+			log.Printf("[SERVER] xds virtual host %q: ignore domain %q: %s", vhost.Name, domain, err)
+			continue
+		}
+
+		domains = append(domains, domain)
+	}
+
+	return domains
+}
+
+// mostSpecificDomain returns the most specific of domains as a pattern.
+func mostSpecificDomain(domains []string) *pattern {
+	var most *pattern
+	for _, domain := range domains {
+		one := newPattern(domain)
+		if more, _ := moreSpecific(&one, most); more || most == nil {
+			most = &one
+		}
+	}
+
+	return most
+}